@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yalp/jsonpath"
+)
+
+// lastSegmentRE splits a jsonpath into the path of the parent and the last
+// member name, quoted member name or array index.
+var lastSegmentRE = regexp.MustCompile(`^(.*)(?:\.([^.\[\]']+)|\['([^']*)'\]|\[([0-9]+)\])$`)
+
+// decodeBase64Paths returns a copy of data in which the strings selected by
+// paths are replaced by their base64 decoded content, parsed as JSON.
+// Values that are not strings or fail to decode are logged and left as
+// they are.
+func decodeBase64Paths(data interface{}, paths []string) interface{} {
+	data = copyJSON(data)
+	for _, path := range paths {
+		m := lastSegmentRE.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		parent, err := jsonpath.Read(data, m[1])
+		if err != nil {
+			slog.Debug("base64 path not found", "jsonpath", path, "error", err)
+			continue
+		}
+		// A parent path with wildcards or recursive descent selects a list
+		// of containers rather than a single one.
+		containers := []interface{}{parent}
+		if list, ok := parent.([]interface{}); ok && (strings.Contains(m[1], "*") || strings.Contains(m[1], "..")) {
+			containers = list
+		}
+		for _, c := range containers {
+			switch c := c.(type) {
+			case map[string]interface{}:
+				key := m[2] + m[3]
+				if v, ok := c[key]; ok && m[4] == "" {
+					c[key] = decodeBase64Value(path, v)
+				}
+			case []interface{}:
+				i, err := strconv.Atoi(m[4])
+				if err == nil && i < len(c) {
+					c[i] = decodeBase64Value(path, c[i])
+				}
+			}
+		}
+	}
+	return data
+}
+
+// decodeBase64Value decodes v, a base64 encoded number or JSON document
+// found at path.
+func decodeBase64Value(path string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		slog.Warn("base64 value is not a string, skipping", "jsonpath", path)
+		return v
+	}
+	s = strings.TrimSpace(s)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.URLEncoding.DecodeString(s)
+	}
+	if err != nil {
+		slog.Warn("decoding base64 value, skipping", "jsonpath", path, "error", err)
+		return v
+	}
+	decoded, err := decodeJSON(b)
+	if err != nil {
+		slog.Warn("base64 value is neither a number nor JSON, skipping", "jsonpath", path, "error", err)
+		return v
+	}
+	return decoded
+}
+
+// copyJSON returns a deep copy of the objects and arrays of a decoded
+// document.
+func copyJSON(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			c[k] = copyJSON(x)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, x := range v {
+			c[i] = copyJSON(x)
+		}
+		return c
+	default:
+		return v
+	}
+}
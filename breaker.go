@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops probing failing targets when --circuit-breaker-failures is
+// set.
+var breaker *circuitBreaker
+
+// circuitBreaker tracks consecutive failures per target. After threshold
+// failures in a row the circuit of a target opens and it is not probed
+// for a cooldown. A failure of the first probe after the cooldown opens
+// it again for twice as long, up to maxCooldown, and a success closes it.
+type circuitBreaker struct {
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*circuit
+}
+
+// circuit is the state of a failing target. Targets that succeed have
+// none.
+type circuit struct {
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown, maxCooldown time.Duration) *circuitBreaker {
+	if maxCooldown < cooldown {
+		maxCooldown = cooldown
+	}
+	return &circuitBreaker{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		maxCooldown: maxCooldown,
+		targets:     map[string]*circuit{},
+	}
+}
+
+// open reports whether the circuit of target is open at now, so it must
+// not be probed.
+func (b *circuitBreaker) open(target string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.targets[target]
+	return ok && now.Before(c.openUntil)
+}
+
+// record updates the circuit of target with the outcome of a probe at now.
+// It returns whether the circuit opened.
+func (b *circuitBreaker) record(target string, success bool, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		delete(b.targets, target)
+		return false
+	}
+	c, ok := b.targets[target]
+	if !ok {
+		c = &circuit{}
+		b.targets[target] = c
+	}
+	c.failures++
+	if c.failures < b.threshold {
+		return false
+	}
+	switch {
+	case c.cooldown == 0:
+		c.cooldown = b.cooldown
+	case c.cooldown < b.maxCooldown:
+		c.cooldown *= 2
+		if c.cooldown > b.maxCooldown {
+			c.cooldown = b.maxCooldown
+		}
+	}
+	c.openUntil = now.Add(c.cooldown)
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeCache holds recent probe results when --cache-ttl is set.
+var probeCache *responseCache
+
+// validatorStore holds the last response with validators of each target
+// when --conditional-requests is set.
+var validatorStore *responseCache
+
+var cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "json_exporter_cache_hits_total",
+	Help: "Number of probes answered from the response cache.",
+})
+
+func init() {
+	prometheus.MustRegister(cacheHitsTotal)
+}
+
+// responseCache is a size bounded LRU cache of probe results that expire
+// after a fixed time, or never if it is 0.
+type responseCache struct {
+	ttl  time.Duration
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	result  *probeResult
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, size int) *responseCache {
+	return &responseCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// get returns a copy of the result cached for key, if it has not expired.
+func (c *responseCache) get(key string) (*probeResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	result := *entry.result
+	return &result, true
+}
+
+// add caches result for key, evicting the least recently used entry if
+// the cache is full.
+func (c *responseCache) add(key string, result *probeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{key: key, result: result, expires: time.Now().Add(c.ttl)}
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey identifies the response to a probe request. Requests differing
+// in anything sent to the target get different keys.
+func (preq probeRequest) cacheKey() string {
+	key := fmt.Sprintf("%s %s\n%s %s\n%q %s %s\n%v\n%s:%s:%s\n%v\n%s\n%+v",
+		preq.Method, preq.Target, preq.Host, preq.ServerName, preq.Body, preq.BodyFile, preq.ContentType, preq.Headers,
+		preq.Username, string(preq.Password), preq.BearerTokenFile,
+		preq.ProxyURL, preq.Format, preq.Login)
+	if preq.SigV4 != nil {
+		key += fmt.Sprintf("\nsigv4 %s %s %s %s", preq.SigV4.Region, preq.SigV4.Service, preq.SigV4.AccessKey, preq.SigV4.Profile)
+	}
+	return key
+}
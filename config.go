@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/yalp/jsonpath"
+	"gopkg.in/yaml.v3"
+
+	"github.com/konikvranik/prometheus-json-exporter/jsonexporter"
+)
+
+// Config is the content of the file given by --config.file.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+}
+
+// Module is a named set of probe settings selected with the module query
+// parameter.
+type Module struct {
+	Prefix    string            `yaml:"prefix"`
+	JSONPath  string            `yaml:"jsonpath"`
+	JSONPaths []NamedPath       `yaml:"jsonpaths"`
+	JQ        string            `yaml:"jq"`
+	Headers   map[string]string `yaml:"headers"`
+	UserAgent string            `yaml:"user_agent"`
+	Timeout   time.Duration     `yaml:"timeout"`
+	Method    string            `yaml:"method"`
+	Body      string            `yaml:"body"`
+	BodyFile  string            `yaml:"body_file"`
+	Username  string            `yaml:"username"`
+	Password  Secret            `yaml:"password"`
+	Labels    map[string]string `yaml:"labels"`
+	Format    string            `yaml:"format"`
+	Mode      string            `yaml:"mode"`
+	Help      []MetricHelp      `yaml:"help"`
+	Types     []MetricType      `yaml:"types"`
+	Rewrites  []MetricRewrite   `yaml:"rewrites"`
+	Units     []UnitConversion  `yaml:"units"`
+	States    []StateSet        `yaml:"states"`
+
+	// NormalizeUnits converts metrics named after a unit such as ms or kb
+	// to the base unit, after the conversions in Units.
+	NormalizeUnits bool `yaml:"normalize_units"`
+	// TraceIDPath is a jsonpath selecting a trace or request ID in the
+	// response, attached as an exemplar to counter metrics.
+	TraceIDPath string `yaml:"trace_id_path"`
+	// TimestampField names the member of the response's objects holding
+	// the time at which their values were sampled.
+	TimestampField string `yaml:"timestamp_field"`
+	// Base64Paths are jsonpaths selecting base64 encoded strings, which
+	// are decoded and parsed as a number or JSON before walking.
+	Base64Paths []string `yaml:"base64_paths"`
+
+	// Pagination fetches the further pages of a list endpoint.
+	Pagination *Pagination `yaml:"pagination"`
+	// SigV4 signs probes for AWS endpoints.
+	SigV4 *SigV4 `yaml:"sigv4"`
+	// Login is sent before every probe, and the cookies it sets are sent
+	// with the probe.
+	Login *Login `yaml:"login"`
+	// Target is a text/template of the target URL used when the probe has
+	// no target parameter, expanded with the query parameters.
+	Target string `yaml:"target"`
+
+	ContentType     string `yaml:"content_type"`
+	Host            string `yaml:"host"`
+	ServerName      string `yaml:"server_name"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	ProxyURL        string `yaml:"proxy_url"`
+
+	proxyURL *url.URL
+}
+
+// NamedPath is a jsonpath whose extracted metrics are prefixed with Name.
+//
+// When LabelField or LabelFields are set the path must select an array of
+// objects, and the metrics of each element are labelled with those fields
+// of the element. Elements without LabelField are skipped, while missing
+// LabelFields get an empty label. Each element yields its ValueField, or
+// its ValueFields, or else all its fields but the label fields.
+//
+// Fields of nested objects are addressed with dots, e.g. "meta.name".
+// Labels are named after the last segment of the field; Label overrides
+// the name of LabelField's label.
+type NamedPath struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+
+	LabelField  string   `yaml:"label_field"`
+	ValueField  string   `yaml:"value_field"`
+	Label       string   `yaml:"label"`
+	LabelFields []string `yaml:"label_fields"`
+	ValueFields []string `yaml:"value_fields"`
+
+	// Transform is a jq expression run on every value extracted by the
+	// path, such as ". * 100", "1 / ." or "[., 100] | min".
+	Transform string `yaml:"transform"`
+
+	transform *gojq.Code
+}
+
+// labeled reports whether the path selects an array of labelled elements.
+func (p NamedPath) labeled() bool {
+	return p.LabelField != "" || len(p.LabelFields) > 0
+}
+
+// labelName returns the name of the label taken from LabelField.
+func (p NamedPath) labelName() string {
+	if p.Label != "" {
+		return p.Label
+	}
+	return fieldName(p.LabelField)
+}
+
+// fieldName returns the last segment of a dotted field path.
+func fieldName(field string) string {
+	return field[strings.LastIndex(field, ".")+1:]
+}
+
+// MetricHelp sets the help text of metrics whose name, without the prefix,
+// matches the glob pattern Match, e.g. "requests_*".
+type MetricHelp struct {
+	Match string `yaml:"match"`
+	Help  string `yaml:"help"`
+}
+
+// helpFor returns the help text of the first pattern matching the metric
+// name, or def if none matches.
+func (m Module) helpFor(name, def string) string {
+	for _, h := range m.Help {
+		if ok, _ := filepath.Match(h.Match, name); ok {
+			return h.Help
+		}
+	}
+	return def
+}
+
+// MetricType sets the type, "gauge" or "counter", of metrics whose name,
+// without the prefix, matches the glob pattern Match, e.g. "*_total".
+type MetricType struct {
+	Match string `yaml:"match"`
+	Type  string `yaml:"type"`
+}
+
+// typeFor returns the type of the first pattern matching the metric name,
+// or "gauge" if none matches.
+func (m Module) typeFor(name string) string {
+	for _, t := range m.Types {
+		if ok, _ := filepath.Match(t.Match, name); ok {
+			return t.Type
+		}
+	}
+	return "gauge"
+}
+
+// Login is a request to a login endpoint setting a session cookie.
+type Login struct {
+	URL    string `yaml:"url"`
+	Method string `yaml:"method"`
+	Body   string `yaml:"body"`
+	// ContentType is sent with Body, "application/json" if empty.
+	ContentType string `yaml:"content_type"`
+}
+
+// MetricRewrite renames metrics whose name, without the prefix, matches
+// the regular expression Match, anchored at both ends, to Replacement, in
+// which $1 and ${name} refer to the groups of Match. A metric renamed to
+// the empty string is dropped.
+type MetricRewrite struct {
+	Match       string `yaml:"match"`
+	Replacement string `yaml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// rewrite applies the module's rewrite rules in order to a metric name.
+// It returns the empty string if the metric is dropped.
+func (m Module) rewrite(name string) string {
+	for _, r := range m.Rewrites {
+		if !r.re.MatchString(name) {
+			continue
+		}
+		name = jsonexporter.SanitizeKey(r.re.ReplaceAllString(name, r.Replacement))
+		if name == "" {
+			return ""
+		}
+	}
+	return name
+}
+
+// UnitConversion converts metrics whose name ends in "_" followed by Suffix
+// to Unit, replacing the suffix and multiplying their value by Scale.
+type UnitConversion struct {
+	Suffix string  `yaml:"suffix"`
+	Unit   string  `yaml:"unit"`
+	Scale  float64 `yaml:"scale"`
+}
+
+// defaultUnits are the conversions to base units applied with
+// normalize_units.
+var defaultUnits = []UnitConversion{
+	{Suffix: "ns", Unit: "seconds", Scale: 1e-9},
+	{Suffix: "nanoseconds", Unit: "seconds", Scale: 1e-9},
+	{Suffix: "us", Unit: "seconds", Scale: 1e-6},
+	{Suffix: "microseconds", Unit: "seconds", Scale: 1e-6},
+	{Suffix: "ms", Unit: "seconds", Scale: 1e-3},
+	{Suffix: "milliseconds", Unit: "seconds", Scale: 1e-3},
+	{Suffix: "minutes", Unit: "seconds", Scale: 60},
+	{Suffix: "hours", Unit: "seconds", Scale: 3600},
+	{Suffix: "kb", Unit: "bytes", Scale: 1 << 10},
+	{Suffix: "mb", Unit: "bytes", Scale: 1 << 20},
+	{Suffix: "gb", Unit: "bytes", Scale: 1 << 30},
+	{Suffix: "kilobytes", Unit: "bytes", Scale: 1 << 10},
+	{Suffix: "megabytes", Unit: "bytes", Scale: 1 << 20},
+	{Suffix: "gigabytes", Unit: "bytes", Scale: 1 << 30},
+}
+
+// convertUnit applies the first of the module's unit conversions matching
+// name to the metric, and then returns its name and value.
+func (m Module) convertUnit(name string, value float64) (string, float64) {
+	conversions := m.Units
+	if m.NormalizeUnits {
+		conversions = append(conversions[:len(conversions):len(conversions)], defaultUnits...)
+	}
+	for _, c := range conversions {
+		if strings.HasSuffix(name, "_"+c.Suffix) {
+			return strings.TrimSuffix(name, c.Suffix) + c.Unit, value * c.Scale
+		}
+	}
+	return name, value
+}
+
+// StateSet exports the string at Path, one of Values, as one metric Name
+// per value, labelled with the value under Label (Name if empty). The
+// metric of the current value is 1 and the others are 0.
+//
+// A value not in Values is logged if Unknown is "log", the default, or
+// exported as an extra metric if it is "add".
+type StateSet struct {
+	Name    string   `yaml:"name"`
+	Path    string   `yaml:"path"`
+	Label   string   `yaml:"label"`
+	Values  []string `yaml:"values"`
+	Unknown string   `yaml:"unknown"`
+}
+
+// labelName returns the name of the label carrying the state.
+func (s StateSet) labelName() string {
+	if s.Label != "" {
+		return s.Label
+	}
+	return s.Name
+}
+
+// Secret is a string that is redacted when printed or logged.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "<secret>"
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	for name, module := range c.Modules {
+		if module.Timeout < 0 {
+			return fmt.Errorf("module %q: timeout must not be negative", name)
+		}
+		if err := checkPrefix(module.Prefix); err != nil {
+			return fmt.Errorf("module %q: %v", name, err)
+		}
+		if !validFormat(module.Format) {
+			return fmt.Errorf("module %q: unknown format %q", name, module.Format)
+		}
+		if !validMode(module.Mode) {
+			return fmt.Errorf("module %q: unknown mode %q", name, module.Mode)
+		}
+		if module.Body != "" && module.BodyFile != "" {
+			return fmt.Errorf("module %q: only one of body and body_file may be set", name)
+		}
+		if module.ContentType != "" && !validContentType(module.ContentType) {
+			return fmt.Errorf("module %q: invalid content_type %q", name, module.ContentType)
+		}
+		if p := module.Pagination; p != nil {
+			if _, err := jsonpath.Prepare(p.ItemsPath); err != nil || !lastSegmentRE.MatchString(p.ItemsPath) {
+				return fmt.Errorf("module %q: pagination items_path %q must be a jsonpath ending in a member or index", name, p.ItemsPath)
+			}
+			if (p.NextPath == "") == (p.PageParam == "") {
+				return fmt.Errorf("module %q: pagination needs either next_path or page_param", name)
+			}
+			if p.NextPath != "" && p.TotalPagesPath != "" {
+				return fmt.Errorf("module %q: pagination total_pages_path requires page_param", name)
+			}
+			for _, path := range []string{p.NextPath, p.TotalPagesPath} {
+				if _, err := jsonpath.Prepare(path); path != "" && err != nil {
+					return fmt.Errorf("module %q: invalid pagination jsonpath %q: %v", name, path, err)
+				}
+			}
+		}
+		if module.SigV4 != nil {
+			if err := module.SigV4.init(context.Background()); err != nil {
+				return fmt.Errorf("module %q: sigv4: %v", name, err)
+			}
+		}
+		if module.Login != nil {
+			if u, err := url.Parse(module.Login.URL); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("module %q: invalid login url %q", name, module.Login.URL)
+			}
+			if module.Login.ContentType != "" && !validContentType(module.Login.ContentType) {
+				return fmt.Errorf("module %q: invalid login content_type %q", name, module.Login.ContentType)
+			}
+		}
+		if module.Target != "" {
+			if _, err := template.New("target").Parse(module.Target); err != nil {
+				return fmt.Errorf("module %q: invalid target template: %v", name, err)
+			}
+		}
+		if module.JSONPath != "" {
+			if _, err := jsonpath.Prepare(module.JSONPath); err != nil {
+				return fmt.Errorf("module %q: invalid jsonpath %q: %v", name, module.JSONPath, err)
+			}
+		}
+		if module.TraceIDPath != "" {
+			if _, err := jsonpath.Prepare(module.TraceIDPath); err != nil {
+				return fmt.Errorf("module %q: invalid trace_id_path %q: %v", name, module.TraceIDPath, err)
+			}
+		}
+		for _, path := range module.Base64Paths {
+			if _, err := jsonpath.Prepare(path); err != nil {
+				return fmt.Errorf("module %q: invalid base64 path %q: %v", name, path, err)
+			}
+			if !lastSegmentRE.MatchString(path) {
+				return fmt.Errorf("module %q: base64 path %q must end in a member or index", name, path)
+			}
+		}
+		if module.ProxyURL != "" {
+			u, err := url.Parse(module.ProxyURL)
+			if err != nil {
+				return fmt.Errorf("module %q: invalid proxy_url: %v", name, err)
+			}
+			module.proxyURL = u
+			c.Modules[name] = module
+		}
+		if module.JQ != "" {
+			if _, err := compileJQ(module.JQ); err != nil {
+				return fmt.Errorf("module %q: invalid jq program: %v", name, err)
+			}
+		}
+		for _, h := range module.Help {
+			if _, err := filepath.Match(h.Match, ""); err != nil {
+				return fmt.Errorf("module %q: invalid help pattern %q: %v", name, h.Match, err)
+			}
+			if strings.TrimSpace(h.Help) == "" {
+				return fmt.Errorf("module %q: empty help text for %q", name, h.Match)
+			}
+		}
+		for _, t := range module.Types {
+			if _, err := filepath.Match(t.Match, ""); err != nil {
+				return fmt.Errorf("module %q: invalid type pattern %q: %v", name, t.Match, err)
+			}
+			if t.Type != "gauge" && t.Type != "counter" {
+				return fmt.Errorf("module %q: unknown metric type %q for %q", name, t.Type, t.Match)
+			}
+		}
+		for i, r := range module.Rewrites {
+			re, err := regexp.Compile("^(?:" + r.Match + ")$")
+			if err != nil {
+				return fmt.Errorf("module %q: invalid rewrite pattern %q: %v", name, r.Match, err)
+			}
+			module.Rewrites[i].re = re
+		}
+		for _, u := range module.Units {
+			if u.Suffix == "" || !metricPrefixRE.MatchString(u.Unit) {
+				return fmt.Errorf("module %q: unit conversion needs a suffix and a valid unit", name)
+			}
+			if u.Scale == 0 {
+				return fmt.Errorf("module %q: unit conversion of %q has no scale", name, u.Suffix)
+			}
+		}
+		for _, state := range module.States {
+			if !metricPrefixRE.MatchString(state.Name) {
+				return fmt.Errorf("module %q: invalid state set name %q", name, state.Name)
+			}
+			if _, err := jsonpath.Prepare(state.Path); err != nil {
+				return fmt.Errorf("module %q: invalid jsonpath %q for state set %q: %v", name, state.Path, state.Name, err)
+			}
+			if !validLabelName(state.labelName()) {
+				return fmt.Errorf("module %q: invalid label name %q for state set %q", name, state.labelName(), state.Name)
+			}
+			if len(state.Values) == 0 {
+				return fmt.Errorf("module %q: state set %q has no values", name, state.Name)
+			}
+			if state.Unknown != "" && state.Unknown != "log" && state.Unknown != "add" {
+				return fmt.Errorf("module %q: unknown must be log or add for state set %q", name, state.Name)
+			}
+		}
+		for label := range module.Labels {
+			if !validLabelName(label) {
+				return fmt.Errorf("module %q: invalid label name %q", name, label)
+			}
+		}
+		for i, path := range module.JSONPaths {
+			if _, err := jsonpath.Prepare(path.Path); err != nil {
+				return fmt.Errorf("module %q: invalid jsonpath %q: %v", name, path.Path, err)
+			}
+			if path.Transform != "" {
+				code, err := compileJQ(path.Transform)
+				if err != nil {
+					return fmt.Errorf("module %q: invalid transform for jsonpath %q: %v", name, path.Path, err)
+				}
+				module.JSONPaths[i].transform = code
+			}
+			if path.LabelField != "" && !validLabelName(path.labelName()) {
+				return fmt.Errorf("module %q: invalid label name %q for jsonpath %q", name, path.labelName(), path.Path)
+			}
+			for _, field := range path.LabelFields {
+				if !validLabelName(fieldName(field)) {
+					return fmt.Errorf("module %q: invalid label name %q for jsonpath %q", name, fieldName(field), path.Path)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// module returns the module selected by name. The empty name selects the
+// built-in defaults.
+func (c *Config) module(name string) (Module, bool) {
+	if name == "" {
+		return Module{}, true
+	}
+	module, ok := c.Modules[name]
+	return module, ok
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// explainer records every value walked during a /probe?debug=true request
+// and is served as JSON instead of the metrics.
+type explainer struct {
+	Target     string           `json:"target"`
+	StatusCode int              `json:"status_code,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Values     []explainedValue `json:"values"`
+
+	// emit exports a value and returns the name of its metric and why it
+	// was skipped, if it was.
+	emit emitFunc
+}
+
+// explainedValue is a walked value, the metric it is exported as and, if
+// it is not exported, the reason.
+type explainedValue struct {
+	Key     string            `json:"key"`
+	Metric  string            `json:"metric,omitempty"`
+	Labels  prometheus.Labels `json:"labels,omitempty"`
+	Value   interface{}       `json:"value"`
+	Ignored string            `json:"ignored,omitempty"`
+	// Timestamp is the time at which the value was sampled, if the
+	// response gives one.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+func (e *explainer) Receive(key string, labels prometheus.Labels, value float64) {
+	e.ReceiveAt(key, labels, value, time.Time{})
+}
+
+func (e *explainer) ReceiveAt(key string, labels prometheus.Labels, value float64, t time.Time) {
+	metric, ignored := e.emit(key, labels, value, t)
+	v := explainedValue{
+		Key:     key,
+		Metric:  metric,
+		Labels:  labels,
+		Value:   explainFloat(value),
+		Ignored: ignored,
+	}
+	if !t.IsZero() {
+		v.Timestamp = &t
+	}
+	e.Values = append(e.Values, v)
+}
+
+func (e *explainer) Ignore(key string, labels prometheus.Labels, value interface{}, reason string) {
+	switch value.(type) {
+	case nil, string, bool, json.Number:
+	default:
+		value = fmt.Sprint(value)
+	}
+	e.Values = append(e.Values, explainedValue{
+		Key:     key,
+		Labels:  labels,
+		Value:   value,
+		Ignored: reason,
+	})
+}
+
+// explainFloat returns v, or its string form if JSON cannot represent it.
+func explainFloat(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return v
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/konikvranik/prometheus-json-exporter/jsonexporter"
+)
+
+type ClientConfig = clientConfig
+
+var NewHTTPClient = newHTTPClient
+
+var NewTransport = newTransport
+
+var LoadConfig = loadConfig
+
+var DoProbe = doProbe
+
+const MaxServerNames = maxServerNames
+
+// ServerNameTransports returns how many per-server-name transports client
+// keeps.
+func ServerNameTransports(client *http.Client) int {
+	t := client.Transport.(*serverNameTransport)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byName)
+}
+
+var IsJSONContentType = isJSONContentType
+
+var ErrResponseTooLarge = errResponseTooLarge
+
+var ErrEmptyResponse = errEmptyResponse
+
+func SetMaxResponseBytes(n int64) (restore func()) {
+	old := maxResponseBytes
+	maxResponseBytes = n
+	return func() { maxResponseBytes = old }
+}
+
+var ProbeHandler = probeHandler
+
+func init() {
+	httpClient, _ = newHTTPClient(clientConfig{})
+}
+
+type ProbeRequest = probeRequest
+
+func SetMaxConcurrentProbes(n int) (restore func()) {
+	old := probeSlots
+	probeSlots = make(chan struct{}, n)
+	return func() { probeSlots = old }
+}
+
+var FailureReason = failureReason
+
+var NewMux = newMux
+
+var Serve = serve
+
+var Listen = listen
+
+func SetProbeRetries(n int) (restore func()) {
+	old := probeRetries
+	probeRetries = n
+	return func() { probeRetries = old }
+}
+
+var RetryAfter = retryAfter
+
+var ScrapeTimeout = scrapeTimeout
+
+func SetTimeoutOffset(d time.Duration) (restore func()) {
+	old := timeoutOffset
+	timeoutOffset = d
+	return func() { timeoutOffset = old }
+}
+
+func SetRespectRetryAfter(enabled bool) (restore func()) {
+	old := respectRetryAfter
+	respectRetryAfter = enabled
+	return func() { respectRetryAfter = old }
+}
+
+type StatusCodes = statusCodes
+
+func (s StatusCodes) Contains(code int) bool { return s.contains(code) }
+
+var RunTestFile = runTestFile
+
+func SetHTTPClient(c *http.Client) (restore func()) {
+	old := httpClient
+	httpClient = c
+	return func() { httpClient = old }
+}
+
+func SetTargetAllowlist(re *regexp.Regexp) (restore func()) {
+	old := targetAllowlist
+	targetAllowlist = re
+	return func() { targetAllowlist = old }
+}
+
+func SetWalker(w *jsonexporter.Walker) (restore func()) {
+	old := walker
+	walker = w
+	return func() { walker = old }
+}
+
+func SetConfig(c *Config) (restore func()) {
+	old := config.Swap(c)
+	return func() { config.Store(old) }
+}
+
+var ReloadHandler = reloadHandler
+
+func SetConfigFile(path string) (restore func()) {
+	old := configFile
+	configFile = path
+	return func() { configFile = old }
+}
+
+func SetEnableOpenMetrics(enable bool) (restore func()) {
+	old := enableOpenMetrics
+	enableOpenMetrics = enable
+	return func() { enableOpenMetrics = old }
+}
+
+func SetCache(ttl time.Duration, size int) (restore func()) {
+	old := probeCache
+	probeCache = newResponseCache(ttl, size)
+	return func() { probeCache = old }
+}
+
+func SetMaxMetrics(n int) (restore func()) {
+	old := maxMetrics
+	maxMetrics = n
+	return func() { maxMetrics = old }
+}
+
+func SetMaxPages(n int) (restore func()) {
+	old := maxPages
+	maxPages = n
+	return func() { maxPages = old }
+}
+
+func SetCollisionSuffix(enabled bool) (restore func()) {
+	old := collisionSuffix
+	collisionSuffix = enabled
+	return func() { collisionSuffix = old }
+}
+
+func SetFailOnErrorStatus(enabled bool) (restore func()) {
+	old := failOnErrorStatus
+	failOnErrorStatus = enabled
+	return func() { failOnErrorStatus = old }
+}
+
+func SetProbeConcurrency(n int) (restore func()) {
+	old := probeConcurrency
+	probeConcurrency = n
+	return func() { probeConcurrency = old }
+}
+
+func SetUpMetric(name string, disabled bool) (restore func()) {
+	oldName, oldDisabled := upMetricName, noUpMetric
+	upMetricName, noUpMetric = name, disabled
+	return func() { upMetricName, noUpMetric = oldName, oldDisabled }
+}
+
+func SetKeyFilters(include, exclude string) (restore func()) {
+	oldInclude, oldExclude := includeKeys, excludeKeys
+	includeKeys, _ = compileKeyFilter(include)
+	excludeKeys, _ = compileKeyFilter(exclude)
+	return func() { includeKeys, excludeKeys = oldInclude, oldExclude }
+}
+
+func SetHTTPTrace(enabled bool) (restore func()) {
+	old := httpTrace
+	httpTrace = enabled
+	return func() { httpTrace = old }
+}
+
+func SetCircuitBreaker(failures int, cooldown time.Duration) (restore func()) {
+	old := breaker
+	breaker = nil
+	if failures > 0 {
+		breaker = newCircuitBreaker(failures, cooldown, cooldown)
+	}
+	return func() { breaker = old }
+}
+
+func SetReady(r bool) (restore func()) {
+	old := ready.Load()
+	ready.Store(r)
+	return func() { ready.Store(old) }
+}
+
+type HeaderNames = headerNames
+
+type KeyReplacements = keyReplacements
+
+func (r KeyReplacements) Replacer() *strings.Replacer { return r.replacer() }
+
+func SetForwardHeaders(names ...string) (restore func()) {
+	old := forwardHeaders
+	forwardHeaders = names
+	return func() { forwardHeaders = old }
+}
+
+func SetWebAuth(username, password string) (restore func()) {
+	old := webAuth
+	webAuth = &credentials{username: username, password: Secret(password)}
+	return func() { webAuth = old }
+}
+
+func SetDefaultPrefix(prefix string) (restore func()) {
+	old := defaultPrefix
+	defaultPrefix = prefix
+	return func() { defaultPrefix = old }
+}
+
+func SetConditionalRequests(size int) (restore func()) {
+	old := validatorStore
+	validatorStore = newResponseCache(0, size)
+	return func() { validatorStore = old }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// indexTemplate is the landing page, listing the configured modules with a
+// form to probe a target.
+var indexTemplate = template.Must(template.New("index").Parse(`<html>
+<head><title>Json Exporter</title></head>
+<body>
+<h1>Json Exporter</h1>
+<form action="/probe" method="get">
+<p>
+<label>Target <input type="text" name="target" size="60" placeholder="http://example.com/stats"></label>
+{{- if .Modules}}
+<label>Module <select name="module">
+<option value="">(none)</option>
+{{- range .Modules}}
+<option value="{{.}}">{{.}}</option>
+{{- end}}
+</select></label>
+{{- end}}
+<label><input type="checkbox" name="debug" value="true"> Debug</label>
+<input type="submit" value="Probe">
+</p>
+</form>
+{{- if .Modules}}
+<h2>Modules</h2>
+<ul>
+{{- range .Modules}}
+<li><form action="/probe" method="get">{{.}}
+<input type="hidden" name="module" value="{{.}}">
+<input type="text" name="target" size="40" placeholder="target">
+<input type="submit" value="Probe">
+</form></li>
+{{- end}}
+</ul>
+{{- end}}
+<p><a href="/metrics">Metrics</a></p>
+<p>Version {{.Version}}</p>
+</body>
+</html>
+`))
+
+// indexHandler serves the landing page.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	c := config.Load()
+	modules := make([]string, 0, len(c.Modules))
+	for name := range c.Modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := indexTemplate.Execute(w, struct {
+		Modules []string
+		Version string
+	}{modules, version})
+	if err != nil {
+		slog.Error("rendering index page", "error", err)
+	}
+}
@@ -0,0 +1,67 @@
+package jsonexporter
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector exporting the values of a JSON
+// document as gauges. The document is set with Update and walked on every
+// Collect.
+type Collector struct {
+	prefix string
+	walker *Walker
+
+	mu   sync.Mutex
+	data interface{}
+}
+
+// NewCollector returns a Collector prefixing metric names with prefix. The
+// document is flattened by walker, or with the default settings if walker
+// is nil.
+func NewCollector(prefix string, walker *Walker) *Collector {
+	if walker == nil {
+		walker = &Walker{}
+	}
+	return &Collector{prefix: prefix, walker: walker}
+}
+
+// Update replaces the exported document. data is a decoded JSON document
+// as produced by encoding/json, and must not be modified afterwards.
+func (c *Collector) Update(data interface{}) {
+	c.mu.Lock()
+	c.data = data
+	c.mu.Unlock()
+}
+
+// Describe sends no descriptors, as the metrics depend on the document;
+// the Collector is unchecked.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends a gauge for every value of the document. Values whose
+// sanitized name and labels equal those of an earlier value are skipped.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	data := c.data
+	c.mu.Unlock()
+
+	seen := map[string]bool{}
+	c.walker.Walk("", data, ReceiverFunc(func(key string, labels prometheus.Labels, value float64) {
+		name := c.prefix + c.walker.SanitizeKey(key)
+		id := name + fmt.Sprint(labels)
+		if seen[id] {
+			slog.Debug("duplicate metric, skipping", "metric", name, "key", key)
+			return
+		}
+		seen[id] = true
+		metric, err := prometheus.NewConstMetric(prometheus.NewDesc(name, "Retrieved value", nil, labels), prometheus.GaugeValue, value)
+		if err != nil {
+			slog.Debug("creating metric", "metric", name, "error", err)
+			return
+		}
+		ch <- metric
+	}))
+}
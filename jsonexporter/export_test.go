@@ -0,0 +1,3 @@
+package jsonexporter
+
+var ParseTimestamp = parseTimestamp
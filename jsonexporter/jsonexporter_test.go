@@ -0,0 +1,852 @@
+package jsonexporter_test
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/konikvranik/prometheus-json-exporter/jsonexporter"
+)
+
+type kvPair struct {
+	key    string
+	labels prometheus.Labels
+	value  float64
+}
+
+type receiver struct {
+	received []kvPair
+}
+
+func (r *receiver) Receive(key string, labels prometheus.Labels, value float64) {
+	r.received = append(r.received, kvPair{key, labels, value})
+}
+
+func TestWalkJSON(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "float value",
+			bytes: []byte(`{"x": 1.0}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 1.0},
+			},
+		},
+		{
+			name:  "int value",
+			bytes: []byte(`{"x": 1}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 1.0},
+			},
+		},
+		{
+			name:  "bool value",
+			bytes: []byte(`{"x": true}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 1.0},
+			},
+		},
+		{
+			name:     "string value",
+			bytes:    []byte(`{"x": "ok"}`),
+			expected: nil,
+		},
+		{
+			name:     "null value",
+			bytes:    []byte(`{"x": null}`),
+			expected: nil,
+		},
+		{
+			name:  "array value",
+			bytes: []byte(`{"x": [1, 2, 3]}`),
+			expected: []kvPair{
+				kvPair{key: "x__0", value: 1},
+				kvPair{key: "x__1", value: 2},
+				kvPair{key: "x__2", value: 3},
+			},
+		},
+		{
+			name:  "nested value",
+			bytes: []byte(`{"x": {"y": 1}}`),
+			expected: []kvPair{
+				kvPair{key: "x_y", value: 1.0},
+			},
+		},
+		{
+			name:  "nested^2 value",
+			bytes: []byte(`{"x": {"y": {"z": 1}}}`),
+			expected: []kvPair{
+				kvPair{key: "x_y_z", value: 1.0},
+			},
+		},
+		{
+			name:  "array in nested value",
+			bytes: []byte(`{"x": {"y": [1, 2, 3]}}`),
+			expected: []kvPair{
+				kvPair{key: "x_y__0", value: 1},
+				kvPair{key: "x_y__1", value: 2},
+				kvPair{key: "x_y__2", value: 3},
+			},
+		},
+		{
+			name:  "array in array value",
+			bytes: []byte(`{"x": [[1, 2], [3, 4]]}`),
+			expected: []kvPair{
+				kvPair{key: "x__0__0", value: 1},
+				kvPair{key: "x__0__1", value: 2},
+				kvPair{key: "x__1__0", value: 3},
+				kvPair{key: "x__1__1", value: 4},
+			},
+		},
+		{
+			name:  "array at root",
+			bytes: []byte(`[1, 2, 3]`),
+			expected: []kvPair{
+				kvPair{key: "__0", value: 1},
+				kvPair{key: "__1", value: 2},
+				kvPair{key: "__2", value: 3},
+			},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			jsonexporter.WalkJSON("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONLabelsFromArrays(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "array value",
+			bytes: []byte(`{"x": [1, 2]}`),
+			expected: []kvPair{
+				kvPair{key: "x", labels: prometheus.Labels{"index": "0"}, value: 1},
+				kvPair{key: "x", labels: prometheus.Labels{"index": "1"}, value: 2},
+			},
+		},
+		{
+			name:  "array of objects",
+			bytes: []byte(`{"items": [{"value": 1}, {"value": 2}]}`),
+			expected: []kvPair{
+				kvPair{key: "items_value", labels: prometheus.Labels{"index": "0"}, value: 1},
+				kvPair{key: "items_value", labels: prometheus.Labels{"index": "1"}, value: 2},
+			},
+		},
+		{
+			name:  "array in array value",
+			bytes: []byte(`{"x": [[1], [2]]}`),
+			expected: []kvPair{
+				kvPair{key: "x", labels: prometheus.Labels{"index": "0", "index_1": "0"}, value: 1},
+				kvPair{key: "x", labels: prometheus.Labels{"index": "1", "index_1": "0"}, value: 2},
+			},
+		},
+		{
+			name:  "scalar",
+			bytes: []byte(`{"x": 1}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 1},
+			},
+		},
+	}
+
+	w := &jsonexporter.Walker{LabelsFromArrays: true, IndexLabel: "index"}
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			w.Walk("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkerCollapseArrays(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "array of numbers",
+			bytes: []byte(`{"x": [1, 2, 1, 1]}`),
+			expected: []kvPair{
+				kvPair{key: "x_count", labels: prometheus.Labels{"value": "1"}, value: 3},
+				kvPair{key: "x_count", labels: prometheus.Labels{"value": "2"}, value: 1},
+			},
+		},
+		{
+			name:  "array of objects",
+			bytes: []byte(`{"items": [{"up": true, "size": 0.5}, {"up": true, "size": 0.5}, {"up": false, "name": "c"}]}`),
+			expected: []kvPair{
+				kvPair{key: "items_size_count", labels: prometheus.Labels{"value": "0.5"}, value: 2},
+				kvPair{key: "items_up_count", labels: prometheus.Labels{"value": "1"}, value: 2},
+				kvPair{key: "items_up_count", labels: prometheus.Labels{"value": "0"}, value: 1},
+			},
+		},
+		{
+			name:     "empty array",
+			bytes:    []byte(`{"x": []}`),
+			expected: nil,
+		},
+	}
+
+	w := &jsonexporter.Walker{CollapseArrays: true}
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			w.Walk("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONLabelsFromScalarArrays(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "array of numbers",
+			bytes: []byte(`{"cpu_usage": [10, 20]}`),
+			expected: []kvPair{
+				kvPair{key: "cpu_usage", labels: prometheus.Labels{"index": "0"}, value: 10},
+				kvPair{key: "cpu_usage", labels: prometheus.Labels{"index": "1"}, value: 20},
+			},
+		},
+		{
+			name:  "array of booleans",
+			bytes: []byte(`{"ok": [true, false]}`),
+			expected: []kvPair{
+				kvPair{key: "ok", labels: prometheus.Labels{"index": "0"}, value: 1},
+				kvPair{key: "ok", labels: prometheus.Labels{"index": "1"}, value: 0},
+			},
+		},
+		{
+			name:  "array of objects",
+			bytes: []byte(`{"items": [{"value": 1}, {"value": 2}]}`),
+			expected: []kvPair{
+				kvPair{key: "items__0_value", value: 1},
+				kvPair{key: "items__1_value", value: 2},
+			},
+		},
+		{
+			name:  "mixed array",
+			bytes: []byte(`{"x": [1, {"value": 2}]}`),
+			expected: []kvPair{
+				kvPair{key: "x__0", value: 1},
+				kvPair{key: "x__1_value", value: 2},
+			},
+		},
+		{
+			name:  "scalar array in object array",
+			bytes: []byte(`{"items": [{"values": [3, 4]}]}`),
+			expected: []kvPair{
+				kvPair{key: "items__0_values", labels: prometheus.Labels{"index": "0"}, value: 3},
+				kvPair{key: "items__0_values", labels: prometheus.Labels{"index": "1"}, value: 4},
+			},
+		},
+	}
+
+	w := &jsonexporter.Walker{LabelsFromScalarArrays: true}
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			w.Walk("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONParseStringNumbers(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "decimal",
+			bytes: []byte(`{"x": "21.5"}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 21.5},
+			},
+		},
+		{
+			name:  "exponent",
+			bytes: []byte(`{"x": "1.2e3"}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 1200},
+			},
+		},
+		{
+			name:  "negative zero",
+			bytes: []byte(`{"x": "-0.0"}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 0},
+			},
+		},
+		{
+			name:  "surrounding whitespace",
+			bytes: []byte(`{"x": " 42\n"}`),
+			expected: []kvPair{
+				kvPair{key: "x", value: 42},
+			},
+		},
+		{
+			name:     "not a number",
+			bytes:    []byte(`{"x": "ok"}`),
+			expected: nil,
+		},
+		{
+			name:     "empty",
+			bytes:    []byte(`{"x": ""}`),
+			expected: nil,
+		},
+	}
+
+	w := &jsonexporter.Walker{ParseStringNumbers: true}
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			w.Walk("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONSeparators(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"a_b": {"c": [1]}}`), &jsonData)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	r := &receiver{}
+	w := &jsonexporter.Walker{KeySeparator: ":", ArraySeparator: "::"}
+	w.Walk("", jsonData, r)
+	expected := []kvPair{
+		kvPair{key: "a_b:c::0", value: 1},
+	}
+	if !reflect.DeepEqual(r.received, expected) {
+		t.Errorf("Got: %#v, expected: %#v", r.received, expected)
+	}
+}
+
+func TestWalkerPathStyleDotted(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"a_b": {"c": [1], "d e": 2}, "a": {"b_c": 3}}`), &jsonData)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	r := &receiver{}
+	w := &jsonexporter.Walker{PathStyle: jsonexporter.PathStyleDotted, ArraySeparator: "__"}
+	w.Walk("", jsonData, r)
+	expected := []kvPair{
+		kvPair{key: "a.b_c", value: 3},
+		kvPair{key: "a_b.c.0", value: 1},
+		kvPair{key: "a_b.d e", value: 2},
+	}
+	if !reflect.DeepEqual(r.received, expected) {
+		t.Errorf("Got: %#v, expected: %#v", r.received, expected)
+	}
+
+	names := []string{}
+	for _, kv := range r.received {
+		names = append(names, w.SanitizeKey(kv.key))
+	}
+	if want := []string{"a:b_c", "a_b:c:0", "a_b:d_e"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Got names: %v, expected: %v", names, want)
+	}
+	if got := w.SanitizeKey("0.x"); got != "_0:x" {
+		t.Errorf("Got %q, expected %q", got, "_0:x")
+	}
+}
+
+func TestWalkerNullValue(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"a": null, "b": 1}`), &jsonData)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testData := []struct {
+		nullValue string
+		expected  []kvPair
+	}{
+		{"", []kvPair{{key: "b", value: 1}}},
+		{jsonexporter.NullSkip, []kvPair{{key: "b", value: 1}}},
+		{jsonexporter.NullZero, []kvPair{{key: "a", value: 0}, {key: "b", value: 1}}},
+	}
+	for _, tt := range testData {
+		r := &receiver{}
+		(&jsonexporter.Walker{NullValue: tt.nullValue}).Walk("", jsonData, r)
+		if !reflect.DeepEqual(r.received, tt.expected) {
+			t.Errorf("%q: got: %#v, expected: %#v", tt.nullValue, r.received, tt.expected)
+		}
+	}
+
+	r := &receiver{}
+	(&jsonexporter.Walker{NullValue: jsonexporter.NullNaN}).Walk("", jsonData, r)
+	if len(r.received) != 2 || r.received[0].key != "a" || !math.IsNaN(r.received[0].value) {
+		t.Errorf("Got: %#v, expected NaN for a", r.received)
+	}
+}
+
+type precisionReceiver struct {
+	receiver
+	lost []string
+}
+
+func (r *precisionReceiver) PrecisionLoss(key string, labels prometheus.Labels, value string) {
+	r.lost = append(r.lost, key)
+}
+
+func TestWalkerPrecisionLoss(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{
+		"big": 12345678901234567891,
+		"exact": 9007199254740992,
+		"decimal": 0.1,
+		"long": 123456789.123456789,
+		"trailing": 1.50000000000000000,
+		"exponent": 1.2345678901234567891e5,
+		"tiny": 1e-400,
+		"zero": 0.0000000000000000,
+		"str": "98765432109876543210.5",
+		"short": "21.5"
+	}`))
+	decoder.UseNumber()
+	var jsonData interface{}
+	if err := decoder.Decode(&jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	r := &precisionReceiver{}
+	(&jsonexporter.Walker{ParseStringNumbers: true}).Walk("", jsonData, r)
+	sort.Strings(r.lost)
+	expected := []string{"big", "exponent", "long", "str", "tiny"}
+	if !reflect.DeepEqual(r.lost, expected) {
+		t.Errorf("Got: %v, expected: %v", r.lost, expected)
+	}
+	if len(r.received) != 10 {
+		t.Errorf("Got %d values, expected 10: %#v", len(r.received), r.received)
+	}
+}
+
+func TestWalkerPrecisionLossCollapseArrays(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{"ids": [9007199254740993, 1, 9007199254740993]}`))
+	decoder.UseNumber()
+	var jsonData interface{}
+	if err := decoder.Decode(&jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	r := &precisionReceiver{}
+	(&jsonexporter.Walker{CollapseArrays: true}).Walk("", jsonData, r)
+	expected := []string{"ids", "ids"}
+	if !reflect.DeepEqual(r.lost, expected) {
+		t.Errorf("Got: %v, expected: %v", r.lost, expected)
+	}
+	if len(r.received) != 2 {
+		t.Errorf("Got %d values, expected 2: %#v", len(r.received), r.received)
+	}
+}
+
+func TestWalkerSanitizeKeyOptions(t *testing.T) {
+	testData := []struct {
+		name     string
+		walker   jsonexporter.Walker
+		key      string
+		expected string
+	}{
+		{
+			name:     "replacements",
+			walker:   jsonexporter.Walker{Replacer: strings.NewReplacer("%", "percent", "App", "")},
+			key:      "AppCpu %",
+			expected: "Cpu_percent",
+		},
+		{
+			name:     "lowercase",
+			walker:   jsonexporter.Walker{LowercaseKeys: true},
+			key:      "HTTPRequests.Total",
+			expected: "httprequests_total",
+		},
+		{
+			name:     "both dotted",
+			walker:   jsonexporter.Walker{Replacer: strings.NewReplacer("-", "_minus_"), LowercaseKeys: true, PathStyle: jsonexporter.PathStyleDotted},
+			key:      "Temp.Delta-C",
+			expected: "temp:delta_minus_c",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.walker.SanitizeKey(tt.key); got != tt.expected {
+				t.Errorf("Got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSanitizeKey(t *testing.T) {
+	testData := []struct {
+		key      string
+		expected string
+	}{
+		{"simple", "simple"},
+		{"with space", "with_space"},
+		{"a/b", "a_b"},
+		{"ns:name", "ns:name"},
+		{"dotted.key-name", "dotted_key_name"},
+		{"call(count)", "call_count_"},
+		{"a / b", "a_b"},
+		{"x__0", "x_0"},
+		{"a__b", "a_b"},
+		{"a_-b", "a_b"},
+		{"a-_b", "a_b"},
+		{"a - _b", "a_b"},
+		{"x-__0", "x_0"},
+		{"__0", "_0"},
+		{"0xdeadbeef", "_0xdeadbeef"},
+		{"temp_°C", "temp_C"},
+		{"status_✅", "status_"},
+		{"温度", "_"},
+		{"température", "temp_rature"},
+		{"", ""},
+	}
+
+	for _, tt := range testData {
+		if got := jsonexporter.SanitizeKey(tt.key); got != tt.expected {
+			t.Errorf("%q: got %q, expected %q", tt.key, got, tt.expected)
+		}
+	}
+}
+
+func TestWalkJSONBoolValues(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{"a": true, "b": false}`), &jsonData)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	trueValue, falseValue := 2.0, -1.0
+	r := &receiver{}
+	w := &jsonexporter.Walker{BoolTrueValue: &trueValue, BoolFalseValue: &falseValue}
+	w.Walk("", jsonData, r)
+	got := map[string]float64{}
+	for _, kv := range r.received {
+		got[kv.key] = kv.value
+	}
+	expected := map[string]float64{"a": 2, "b": -1}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %#v, expected: %#v", got, expected)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	testData := []struct {
+		value    string
+		expected float64
+		ok       bool
+	}{
+		{"2024-01-02T15:04:05Z", 1704207845, true},
+		{"2024-01-02T16:04:05+01:00", 1704207845, true},
+		{"2024-01-02T15:04:05.5Z", 1704207845.5, true},
+		{"2024-01-02T15:04:05", 1704207845, true},
+		{"2024-01-02 15:04:05", 1704207845, true},
+		{"Tue, 02 Jan 2024 15:04:05 +0000", 1704207845, true},
+		{"2024-01-02", 1704153600, true},
+		{"yesterday", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range testData {
+		got, ok := jsonexporter.ParseTimestamp(tt.value)
+		if got != tt.expected || ok != tt.ok {
+			t.Errorf("%q: got %v %v, expected %v %v", tt.value, got, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestWalkJSONStringAsInfo(t *testing.T) {
+	testData := []struct {
+		name     string
+		bytes    []byte
+		expected []kvPair
+	}{
+		{
+			name:  "string",
+			bytes: []byte(`{"version": "1.2.3"}`),
+			expected: []kvPair{
+				kvPair{key: "version_info", labels: prometheus.Labels{"value": "1.2.3"}, value: 1},
+			},
+		},
+		{
+			name:  "truncated",
+			bytes: []byte(`{"msg": "abcdefghij"}`),
+			expected: []kvPair{
+				kvPair{key: "msg_info", labels: prometheus.Labels{"value": "abcde"}, value: 1},
+			},
+		},
+		{
+			name:     "empty",
+			bytes:    []byte(`{"msg": ""}`),
+			expected: nil,
+		},
+	}
+
+	w := &jsonexporter.Walker{StringAsInfo: true, MaxInfoLength: 5}
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var jsonData interface{}
+			err := json.Unmarshal(tt.bytes, &jsonData)
+			if err != nil {
+				t.Errorf("Error: %v", err)
+			}
+
+			r := &receiver{}
+			w.Walk("", jsonData, r)
+			if !reflect.DeepEqual(r.received, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWalkJSONLargeInteger(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{"id": 1234567890123456789, "small": 42}`))
+	decoder.UseNumber()
+	var jsonData interface{}
+	if err := decoder.Decode(&jsonData); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	r := &receiver{}
+	jsonexporter.WalkJSON("", jsonData, r)
+	got := map[string]float64{}
+	for _, kv := range r.received {
+		got[kv.key] = kv.value
+	}
+	expected := map[string]float64{"id": 1234567890123456789, "small": 42}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %#v, expected: %#v", got, expected)
+	}
+}
+
+func TestWalkerMaxDepth(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"a": 1, "b": {"c": 2, "d": {"e": 3}}, "f": [4, [5]]}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{}
+	(&jsonexporter.Walker{MaxDepth: 2}).Walk("", data, r)
+	got := map[string]float64{}
+	for _, kv := range r.received {
+		got[kv.key] = kv.value
+	}
+	expected := map[string]float64{"a": 1, "b_c": 2, "f__0": 4}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %#v, expected: %#v", got, expected)
+	}
+}
+
+type timestampReceiver struct {
+	receiver
+	timestamps map[string]time.Time
+}
+
+func (r *timestampReceiver) ReceiveAt(key string, labels prometheus.Labels, value float64, t time.Time) {
+	r.Receive(key, labels, value)
+	r.timestamps[key] = t
+}
+
+func TestWalkerTimestampField(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{
+		"a": 1,
+		"b": {"value": 2, "ts": 1700000000},
+		"c": {"value": 3, "ts": 1700000000500, "d": {"value": 4}},
+		"e": {"value": 5, "ts": "2023-11-14T22:13:20Z"},
+		"f": {"value": 6, "ts": "yesterday"}
+	}`), &jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &timestampReceiver{timestamps: map[string]time.Time{}}
+	w := &jsonexporter.Walker{TimestampField: "ts"}
+	w.Walk("", jsonData, r)
+
+	expected := map[string]time.Time{
+		"b_value":   time.Unix(1700000000, 0),
+		"c_value":   time.Unix(1700000000, 5e8),
+		"c_d_value": time.Unix(1700000000, 5e8),
+		"e_value":   time.Unix(1700000000, 0),
+	}
+	if !reflect.DeepEqual(r.timestamps, expected) {
+		t.Errorf("Got: %v, expected: %v", r.timestamps, expected)
+	}
+	for _, kv := range r.received {
+		if strings.HasSuffix(kv.key, "ts") {
+			t.Errorf("Expected the timestamp field not to be walked, got %s", kv.key)
+		}
+	}
+	if len(r.received) != 6 {
+		t.Errorf("Got %d values, expected 6: %v", len(r.received), r.received)
+	}
+}
+
+func TestWalkerCollapseArraysTimestampField(t *testing.T) {
+	var jsonData interface{}
+	err := json.Unmarshal([]byte(`{
+		"ts": 1600000000,
+		"jobs": [
+			{"ok": true, "ts": 1700000000},
+			{"ok": true, "ts": 1700000060}
+		],
+		"flags": [{"on": true}]
+	}`), &jsonData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &timestampReceiver{timestamps: map[string]time.Time{}}
+	w := &jsonexporter.Walker{CollapseArrays: true, TimestampField: "ts"}
+	w.Walk("", jsonData, r)
+
+	expected := map[string]time.Time{
+		"jobs_ok_count":  time.Unix(1700000060, 0),
+		"flags_on_count": time.Unix(1600000000, 0),
+	}
+	if !reflect.DeepEqual(r.timestamps, expected) {
+		t.Errorf("Got: %v, expected: %v", r.timestamps, expected)
+	}
+}
+
+func TestWalkJSONErr(t *testing.T) {
+	var jsonData interface{}
+	if err := json.Unmarshal([]byte(`{"a": 1, "b": "text", "c": null, "d": [true]}`), &jsonData); err != nil {
+		t.Fatal(err)
+	}
+
+	values, warnings := jsonexporter.WalkJSONErr("", jsonData)
+	expectedValues := []jsonexporter.Value{
+		{Key: "a", Value: 1},
+		{Key: "d__0", Value: 1},
+	}
+	if !reflect.DeepEqual(values, expectedValues) {
+		t.Errorf("Got values: %v, expected: %v", values, expectedValues)
+	}
+	expectedWarnings := []jsonexporter.Warning{
+		{Key: "b", Value: "text", Reason: "string"},
+		{Key: "c", Reason: "null"},
+	}
+	if !reflect.DeepEqual(warnings, expectedWarnings) {
+		t.Errorf("Got warnings: %v, expected: %v", warnings, expectedWarnings)
+	}
+}
+
+func TestWalkJSONSortedKeys(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"c": 1, "a": {"z": 2, "b": 3}, "b": [4, 5]}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &receiver{}
+	jsonexporter.WalkJSON("", data, r)
+	var got []string
+	for _, kv := range r.received {
+		got = append(got, kv.key)
+	}
+	expected := []string{"a_b", "a_z", "b__0", "b__1", "c"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %v, expected: %v", got, expected)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(`{"a": 1, "b": {"c": 2}, "b_c": 3, "d": "text"}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := jsonexporter.NewCollector("app_", nil)
+	collector.Update(data)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	var got []string
+	for m := range ch {
+		got = append(got, m.Desc().String())
+	}
+	if len(got) != 2 {
+		t.Fatalf("Got %d metrics, expected 2: %v", len(got), got)
+	}
+	for i, name := range []string{`"app_a"`, `"app_b_c"`} {
+		if !strings.Contains(got[i], name) {
+			t.Errorf("Got %s, expected metric %s", got[i], name)
+		}
+	}
+}
@@ -0,0 +1,644 @@
+// Package jsonexporter turns JSON documents into Prometheus metrics.
+//
+// A Walker flattens a decoded document, as produced by encoding/json, into
+// keys and values passed to a Receiver. A Collector exposes a document as
+// gauges to a prometheus.Registry.
+package jsonexporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ReceiverFunc adapts a function to a Receiver.
+type ReceiverFunc func(key string, labels prometheus.Labels, value float64)
+
+func (receiver ReceiverFunc) Receive(key string, labels prometheus.Labels, value float64) {
+	receiver(key, labels, value)
+}
+
+// Receiver is passed every value found by a Walker, with its flattened key
+// and the labels collected on the way.
+type Receiver interface {
+	Receive(key string, labels prometheus.Labels, value float64)
+}
+
+// IgnoreReceiver is optionally implemented by a Receiver to learn about the
+// values that are skipped, and why.
+type IgnoreReceiver interface {
+	Ignore(key string, labels prometheus.Labels, value interface{}, reason string)
+}
+
+// TimestampReceiver is optionally implemented by a Receiver to learn about
+// the time at which values were sampled, as found in the Walker's
+// TimestampField.
+type TimestampReceiver interface {
+	ReceiveAt(key string, labels prometheus.Labels, value float64, t time.Time)
+}
+
+// ReceiveAt passes a value sampled at t to receiver, calling ReceiveAt if
+// it is a TimestampReceiver and t is not zero, and Receive otherwise.
+func ReceiveAt(receiver Receiver, key string, labels prometheus.Labels, value float64, t time.Time) {
+	if r, ok := receiver.(TimestampReceiver); ok && !t.IsZero() {
+		r.ReceiveAt(key, labels, value, t)
+		return
+	}
+	receiver.Receive(key, labels, value)
+}
+
+// PrecisionLossReceiver is optionally implemented by a Receiver to learn
+// about the numbers whose digits do not all fit a float64, which are passed
+// on rounded to the nearest float64.
+type PrecisionLossReceiver interface {
+	PrecisionLoss(key string, labels prometheus.Labels, value string)
+}
+
+// PrecisionLoss tells receiver, if it is a PrecisionLossReceiver, that the
+// number value at key was rounded.
+func PrecisionLoss(receiver Receiver, key string, labels prometheus.Labels, value string) {
+	if r, ok := receiver.(PrecisionLossReceiver); ok {
+		r.PrecisionLoss(key, labels, value)
+	}
+}
+
+// Ignore tells receiver, if it is an IgnoreReceiver, that the value at key
+// was skipped for reason.
+func Ignore(receiver Receiver, key string, labels prometheus.Labels, value interface{}, reason string) {
+	if r, ok := receiver.(IgnoreReceiver); ok {
+		r.Ignore(key, labels, value, reason)
+	}
+}
+
+// Walker controls how WalkJSON flattens a document into metric keys.
+type Walker struct {
+	// LabelsFromArrays turns array indices into labels instead of
+	// baking them into the key.
+	LabelsFromArrays bool
+	// LabelsFromScalarArrays does the same only for arrays whose elements
+	// are all numbers or booleans, so [10, 20] becomes one labelled
+	// metric while arrays of objects stay in the key.
+	LabelsFromScalarArrays bool
+	// CollapseArrays walks all elements of an array under the same key and
+	// passes on, for every value found, the number of elements having it
+	// as <key>_count, labelled with the value. It takes precedence over
+	// LabelsFromArrays and LabelsFromScalarArrays.
+	CollapseArrays bool
+	// IndexLabel names the label carrying the array index. Nested arrays
+	// get the depth appended, e.g. index, index_1, index_2.
+	IndexLabel string
+	// ParseStringNumbers emits string values that parse as numbers.
+	ParseStringNumbers bool
+	// ParseTimestamps emits string values that parse as timestamps as
+	// Unix epoch seconds.
+	ParseTimestamps bool
+	// StringAsInfo emits remaining non-empty strings as <key>_info with
+	// value 1 and the string in the value label, cut to MaxInfoLength.
+	StringAsInfo  bool
+	MaxInfoLength int
+	// KeySeparator joins nested object keys, "_" if empty.
+	KeySeparator string
+	// ArraySeparator joins a key and an array index, "__" if empty.
+	ArraySeparator string
+	// PathStyle is PathStyleDotted to join both object keys and array
+	// indices with dots, as in "a.b.0.c", ignoring the separators. Walker
+	// SanitizeKey then turns the dots into colons.
+	PathStyle string
+	// Replacer, if set, is applied by Walker SanitizeKey to keys before
+	// their illegal characters are replaced.
+	Replacer *strings.Replacer
+	// LowercaseKeys makes Walker SanitizeKey lowercase metric names.
+	LowercaseKeys bool
+	// BoolTrueValue and BoolFalseValue replace the values 1 and 0 emitted
+	// for booleans when set.
+	BoolTrueValue  *float64
+	BoolFalseValue *float64
+	// NullValue is NullZero or NullNaN to emit nulls as 0 or NaN instead
+	// of skipping them.
+	NullValue string
+	// MaxDepth limits how deeply nested arrays and objects are walked;
+	// deeper ones are skipped. There is no limit if it is 0.
+	MaxDepth int
+	// TimestampField names an object member holding the time at which the
+	// other values of the object, and of the objects nested in it, were
+	// sampled. It is given in Unix seconds, or milliseconds if above
+	// 1e11, or as a time string, and is not walked itself.
+	TimestampField string
+}
+
+// exactFloat reports whether f, parsed from the decimal number s, has all
+// the significant digits of s. Numbers of up to 15 digits always do, as do
+// numbers s that are not decimal, such as "NaN" and hexadecimal ones.
+func exactFloat(s string, f float64) bool {
+	if len(s) <= 15 && !strings.ContainsAny(s, "eE") {
+		return true
+	}
+	digits, exp, ok := decimal(s)
+	if !ok {
+		return true
+	}
+	fdigits, fexp, _ := decimal(strconv.FormatFloat(f, 'e', -1, 64))
+	return digits == fdigits && exp == fexp
+}
+
+// decimal returns the significant digits of the decimal number s, without
+// leading or trailing zeros, and the exponent placing the decimal point
+// before them. Zero has no digits.
+func decimal(s string) (string, int, bool) {
+	s = strings.TrimLeft(s, "+-")
+	mantissa, exponent, hasExp := strings.Cut(strings.ToLower(s), "e")
+	exp := 0
+	if hasExp {
+		var err error
+		if exp, err = strconv.Atoi(exponent); err != nil {
+			return "", 0, false
+		}
+	}
+	integer, fraction, _ := strings.Cut(mantissa, ".")
+	digits := integer + fraction
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return "", 0, false
+	}
+	exp += len(integer)
+	trimmed := strings.TrimLeft(digits, "0")
+	exp -= len(digits) - len(trimmed)
+	digits = strings.TrimRight(trimmed, "0")
+	if digits == "" {
+		return "", 0, true
+	}
+	return digits, exp, true
+}
+
+// infoLabel carries the string of a StringAsInfo metric.
+const infoLabel = "value"
+
+// Defaults used for the unset fields of a Walker.
+const (
+	DefaultMaxInfoLength  = 100
+	DefaultIndexLabel     = "index"
+	DefaultKeySeparator   = "_"
+	DefaultArraySeparator = "__"
+)
+
+// Path styles of a Walker.
+const (
+	PathStyleUnderscore = "underscore"
+	PathStyleDotted     = "dotted"
+)
+
+// Treatments of null values by a Walker.
+const (
+	NullSkip = "skip"
+	NullZero = "zero"
+	NullNaN  = "nan"
+)
+
+// WalkJSON flattens jsonData with the default settings, encoding array
+// indices into the key.
+func WalkJSON(path string, jsonData interface{}, receiver Receiver) {
+	(&Walker{}).Walk(path, jsonData, receiver)
+}
+
+// Walk flattens jsonData, passing every value to receiver. Keys are
+// prefixed with path.
+func (w *Walker) Walk(path string, jsonData interface{}, receiver Receiver) {
+	w.walk(path, nil, 0, time.Time{}, jsonData, receiver)
+}
+
+// Value is a value found by WalkErr, sampled at Time if it is not zero.
+type Value struct {
+	Key    string
+	Labels prometheus.Labels
+	Value  float64
+	Time   time.Time
+}
+
+// Warning is a value skipped by WalkErr, and why.
+type Warning struct {
+	Key    string
+	Labels prometheus.Labels
+	Value  interface{}
+	Reason string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Key, w.Reason)
+}
+
+// recorder records the values and warnings of WalkErr, and the numbers
+// that lost precision.
+type recorder struct {
+	values          []Value
+	warnings        []Warning
+	precisionLosses []precisionLoss
+}
+
+// precisionLoss is a number rounded by the walk.
+type precisionLoss struct {
+	key    string
+	labels prometheus.Labels
+	value  string
+}
+
+func (c *recorder) Receive(key string, labels prometheus.Labels, value float64) {
+	c.values = append(c.values, Value{Key: key, Labels: labels, Value: value})
+}
+
+func (c *recorder) ReceiveAt(key string, labels prometheus.Labels, value float64, t time.Time) {
+	c.values = append(c.values, Value{key, labels, value, t})
+}
+
+func (c *recorder) Ignore(key string, labels prometheus.Labels, value interface{}, reason string) {
+	c.warnings = append(c.warnings, Warning{key, labels, value, reason})
+}
+
+func (c *recorder) PrecisionLoss(key string, labels prometheus.Labels, value string) {
+	c.precisionLosses = append(c.precisionLosses, precisionLoss{key, labels, value})
+}
+
+// WalkJSONErr flattens jsonData like WalkJSON, returning the values found
+// and the values skipped instead of passing them to a Receiver.
+func WalkJSONErr(path string, jsonData interface{}) ([]Value, []Warning) {
+	return (&Walker{}).WalkErr(path, jsonData)
+}
+
+// WalkErr flattens jsonData like Walk, returning the values found and the
+// values skipped instead of passing them to a Receiver.
+func (w *Walker) WalkErr(path string, jsonData interface{}) ([]Value, []Warning) {
+	c := &recorder{}
+	w.Walk(path, jsonData, c)
+	return c.values, c.warnings
+}
+
+func (w *Walker) indexLabel(depth int) string {
+	name := w.IndexLabel
+	if name == "" {
+		name = DefaultIndexLabel
+	}
+	if depth > 0 {
+		name = fmt.Sprintf("%s_%d", name, depth)
+	}
+	return name
+}
+
+// Key returns the key of the object member key nested under path.
+func (w *Walker) Key(path, key string) string {
+	if path == "" {
+		return key
+	}
+	sep := w.KeySeparator
+	switch {
+	case w.PathStyle == PathStyleDotted:
+		sep = "."
+	case sep == "":
+		sep = DefaultKeySeparator
+	}
+	return path + sep + key
+}
+
+// Index returns the key of the array element i nested under path.
+func (w *Walker) Index(path string, i int) string {
+	sep := w.ArraySeparator
+	switch {
+	case w.PathStyle == PathStyleDotted:
+		sep = "."
+	case sep == "":
+		sep = DefaultArraySeparator
+	}
+	return path + sep + strconv.Itoa(i)
+}
+
+// SanitizeKey turns a key built by the Walker into a valid metric name,
+// after applying Replacer. With PathStyleDotted every dot becomes a colon,
+// so the path separator stays distinct from underscores within keys; the
+// rest of the key is sanitized by the SanitizeKey function.
+func (w *Walker) SanitizeKey(key string) string {
+	if w.Replacer != nil {
+		key = w.Replacer.Replace(key)
+	}
+	var name string
+	if w.PathStyle != PathStyleDotted {
+		name = SanitizeKey(key)
+	} else {
+		segments := strings.Split(key, ".")
+		for i, segment := range segments {
+			segments[i] = sanitizeSegment(segment)
+		}
+		name = strings.Join(segments, ":")
+		if name != "" && name[0] >= '0' && name[0] <= '9' {
+			name = "_" + name
+		}
+	}
+	if w.LowercaseKeys {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// timestampLayouts are tried in order by parseTimestamp. Layouts without a
+// zone are taken as UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	time.RFC1123Z,
+	time.RFC1123,
+	"2006-01-02",
+}
+
+// parseTimestamp parses s in one of the timestampLayouts and returns it as
+// Unix epoch seconds.
+func parseTimestamp(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return float64(t.UnixNano()) / 1e9, true
+		}
+	}
+	return 0, false
+}
+
+// maxSecondsTimestamp is the largest numeric timestamp taken as seconds;
+// larger ones are taken as milliseconds.
+const maxSecondsTimestamp = 1e11
+
+// Timestamp returns the time held by the TimestampField of the object
+// data, or the zero time if it has none.
+func (w *Walker) Timestamp(data interface{}) time.Time {
+	v, ok := data.(map[string]interface{})
+	if !ok {
+		return time.Time{}
+	}
+	return w.sampleTime("", v, time.Time{})
+}
+
+// sampleTime returns the time of an object's TimestampField, or t if it
+// has none.
+func (w *Walker) sampleTime(path string, v map[string]interface{}, t time.Time) time.Time {
+	if w.TimestampField == "" {
+		return t
+	}
+	raw, ok := v[w.TimestampField]
+	if !ok {
+		return t
+	}
+	var seconds float64
+	switch ts := raw.(type) {
+	case json.Number:
+		n, err := ts.Float64()
+		if err != nil {
+			slog.Debug("invalid timestamp", "path", path, "value", ts.String())
+			return t
+		}
+		seconds = n
+	case float64:
+		seconds = ts
+	case int:
+		seconds = float64(ts)
+	case string:
+		n, ok := parseTimestamp(ts)
+		if !ok {
+			slog.Debug("invalid timestamp", "path", path, "value", ts)
+			return t
+		}
+		seconds = n
+	default:
+		slog.Debug("invalid timestamp", "path", path, "value", fmt.Sprint(ts))
+		return t
+	}
+	if math.Abs(seconds) > maxSecondsTimestamp {
+		seconds /= 1000
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func (w *Walker) truncateInfo(v string) string {
+	max := w.MaxInfoLength
+	if max <= 0 {
+		max = DefaultMaxInfoLength
+	}
+	if utf8.RuneCountInString(v) <= max {
+		return v
+	}
+	return string([]rune(v)[:max])
+}
+
+func (w *Walker) boolValue(v bool) float64 {
+	switch {
+	case v && w.BoolTrueValue != nil:
+		return *w.BoolTrueValue
+	case v:
+		return 1.0
+	case w.BoolFalseValue != nil:
+		return *w.BoolFalseValue
+	default:
+		return 0.0
+	}
+}
+
+// tooDeep reports, and logs, whether an array or object at depth exceeds
+// MaxDepth.
+func (w *Walker) tooDeep(path string, depth int) bool {
+	if w.MaxDepth <= 0 || depth < w.MaxDepth {
+		return false
+	}
+	slog.Warn("maximum depth exceeded, skipping", "path", path, "max_depth", w.MaxDepth)
+	return true
+}
+
+func (w *Walker) walk(path string, labels prometheus.Labels, depth int, t time.Time, jsonData interface{}, receiver Receiver) {
+	switch v := jsonData.(type) {
+	case int:
+		ReceiveAt(receiver, path, labels, float64(v), t)
+	case float64:
+		ReceiveAt(receiver, path, labels, v, t)
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			slog.Debug("invalid number", "path", path, "value", v.String())
+			Ignore(receiver, path, labels, v, "invalid number")
+			return
+		}
+		if !exactFloat(v.String(), n) {
+			slog.Debug("number exceeds float64 precision", "path", path, "value", v.String())
+			PrecisionLoss(receiver, path, labels, v.String())
+		}
+		ReceiveAt(receiver, path, labels, n, t)
+	case bool:
+		ReceiveAt(receiver, path, labels, w.boolValue(v), t)
+	case string:
+		if w.ParseStringNumbers {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				if !exactFloat(strings.TrimSpace(v), n) {
+					slog.Debug("number exceeds float64 precision", "path", path, "value", v)
+					PrecisionLoss(receiver, path, labels, v)
+				}
+				ReceiveAt(receiver, path, labels, n, t)
+				return
+			}
+		}
+		if w.ParseTimestamps {
+			if n, ok := parseTimestamp(v); ok {
+				ReceiveAt(receiver, path, labels, n, t)
+				return
+			}
+		}
+		if w.StringAsInfo && v != "" {
+			l := make(prometheus.Labels, len(labels)+1)
+			for k, lv := range labels {
+				l[k] = lv
+			}
+			l[infoLabel] = w.truncateInfo(v)
+			ReceiveAt(receiver, path+"_info", l, 1, t)
+			return
+		}
+		Ignore(receiver, path, labels, v, "string")
+	case nil:
+		switch w.NullValue {
+		case NullZero:
+			ReceiveAt(receiver, path, labels, 0, t)
+		case NullNaN:
+			ReceiveAt(receiver, path, labels, math.NaN(), t)
+		default:
+			Ignore(receiver, path, labels, v, "null")
+		}
+	case []interface{}:
+		if w.tooDeep(path, depth) {
+			Ignore(receiver, path, labels, nil, "max depth")
+			return
+		}
+		if w.CollapseArrays {
+			w.collapse(path, labels, depth, t, v, receiver)
+			return
+		}
+		if w.LabelsFromArrays || w.LabelsFromScalarArrays && scalarArray(v) {
+			name := w.indexLabel(len(labels))
+			for i, x := range v {
+				l := make(prometheus.Labels, len(labels)+1)
+				for k, lv := range labels {
+					l[k] = lv
+				}
+				l[name] = strconv.Itoa(i)
+				w.walk(path, l, depth+1, t, x, receiver)
+			}
+			return
+		}
+		for i, x := range v {
+			w.walk(w.Index(path, i), labels, depth+1, t, x, receiver)
+		}
+	case map[string]interface{}:
+		if w.tooDeep(path, depth) {
+			Ignore(receiver, path, labels, nil, "max depth")
+			return
+		}
+		t = w.sampleTime(path, v, t)
+		// Walk keys in order so metrics are always emitted in the same
+		// order.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			if w.TimestampField == "" || k != w.TimestampField {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.walk(w.Key(path, k), labels, depth+1, t, v[k], receiver)
+		}
+	default:
+		slog.Debug("unknown type", "path", path, "value", fmt.Sprintf("%#v", v))
+		Ignore(receiver, path, labels, fmt.Sprint(v), "unknown type")
+	}
+}
+
+// collapse walks the elements of the array v and passes on the number of
+// elements with each value found, in the order the values were first seen.
+// Each count is sampled at the latest time of the elements counted.
+func (w *Walker) collapse(path string, labels prometheus.Labels, depth int, t time.Time, v []interface{}, receiver Receiver) {
+	c := &recorder{}
+	for _, x := range v {
+		w.walk(path, labels, depth+1, t, x, c)
+	}
+	index := map[string]int{}
+	var series []Value
+	for _, value := range c.values {
+		l := make(prometheus.Labels, len(value.Labels)+1)
+		for k, lv := range value.Labels {
+			l[k] = lv
+		}
+		l[infoLabel] = strconv.FormatFloat(value.Value, 'g', -1, 64)
+		id := value.Key + fmt.Sprint(l)
+		i, ok := index[id]
+		if !ok {
+			i = len(series)
+			index[id] = i
+			series = append(series, Value{Key: value.Key, Labels: l, Time: value.Time})
+		}
+		series[i].Value++
+		if value.Time.After(series[i].Time) {
+			series[i].Time = value.Time
+		}
+	}
+	for _, s := range series {
+		ReceiveAt(receiver, s.Key+"_count", s.Labels, s.Value, s.Time)
+	}
+	for _, warning := range c.warnings {
+		Ignore(receiver, warning.Key, warning.Labels, warning.Value, warning.Reason)
+	}
+	for _, loss := range c.precisionLosses {
+		PrecisionLoss(receiver, loss.key, loss.labels, loss.value)
+	}
+}
+
+// scalarArray reports whether every element of v is a number or boolean.
+func scalarArray(v []interface{}) bool {
+	for _, x := range v {
+		switch x.(type) {
+		case int, float64, json.Number, bool:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SanitizeKey turns a flattened JSON key into a valid metric name. Every
+// character outside [a-zA-Z0-9_:] becomes an underscore and every run of
+// underscores is collapsed into one, so "a.-b" and "a__b" both become
+// "a_b". A leading digit is prefixed with an underscore.
+func SanitizeKey(key string) string {
+	name := sanitizeSegment(key)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// sanitizeSegment replaces every character outside [a-zA-Z0-9_:] in key
+// with an underscore and collapses runs of underscores.
+func sanitizeSegment(key string) string {
+	var b strings.Builder
+	underscore := false
+	for _, c := range key {
+		if c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			underscore = false
+			continue
+		}
+		if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return b.String()
+}
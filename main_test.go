@@ -1,128 +1,3605 @@
 package main_test
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/konikvranik/prometheus-json-exporter"
+	"github.com/konikvranik/prometheus-json-exporter/jsonexporter"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type kvPair struct {
-	key   string
-	value float64
+	key    string
+	labels prometheus.Labels
+	value  float64
 }
 
 type receiver struct {
 	received []kvPair
 }
 
-func (r *receiver) Receive(key string, value float64) {
-	r.received = append(r.received, kvPair{key, value})
+func (r *receiver) Receive(key string, labels prometheus.Labels, value float64) {
+	r.received = append(r.received, kvPair{key, labels, value})
 }
 
-func TestWalkJSON(t *testing.T) {
+func TestNewHTTPClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	caFile, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile.Close()
+
+	testData := []struct {
+		name    string
+		cfg     main.ClientConfig
+		success bool
+	}{
+		{
+			name:    "verify without CA",
+			cfg:     main.ClientConfig{},
+			success: false,
+		},
+		{
+			name:    "skip verify",
+			cfg:     main.ClientConfig{InsecureSkipVerify: true},
+			success: true,
+		},
+		{
+			name:    "verify with CA",
+			cfg:     main.ClientConfig{CAFile: caFile.Name()},
+			success: true,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := main.NewHTTPClient(tt.cfg)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.success {
+				t.Errorf("Got error: %v, expected success: %v", err, tt.success)
+			}
+		})
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	testData := []struct {
+		name string
+		cfg  main.ClientConfig
+	}{
+		{name: "defaults", cfg: main.ClientConfig{}},
+		{name: "tuned", cfg: main.ClientConfig{MaxIdleConnsPerHost: 20, IdleConnTimeout: 30 * time.Second}},
+		{name: "no keepalives", cfg: main.ClientConfig{DisableKeepAlives: true}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := main.NewTransport(tt.cfg, &tls.Config{})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if transport.MaxIdleConnsPerHost != tt.cfg.MaxIdleConnsPerHost {
+				t.Errorf("Got MaxIdleConnsPerHost %d, expected %d", transport.MaxIdleConnsPerHost, tt.cfg.MaxIdleConnsPerHost)
+			}
+			if transport.IdleConnTimeout != tt.cfg.IdleConnTimeout {
+				t.Errorf("Got IdleConnTimeout %v, expected %v", transport.IdleConnTimeout, tt.cfg.IdleConnTimeout)
+			}
+			if transport.DisableKeepAlives != tt.cfg.DisableKeepAlives {
+				t.Errorf("Got DisableKeepAlives %v, expected %v", transport.DisableKeepAlives, tt.cfg.DisableKeepAlives)
+			}
+			if !transport.ForceAttemptHTTP2 {
+				t.Error("Expected HTTP/2 to be attempted")
+			}
+		})
+	}
+}
+
+func TestDoProbeDNSLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	out := probe(t, `{"a": 1}`, "")
+	if !strings.Contains(out, "dns_lookup_seconds 0\n") {
+		t.Errorf("Expected no lookup for an IP target, got:\n%s", out)
+	}
+	result, err := main.DoProbe(context.Background(), &http.Client{}, main.ProbeRequest{Method: "GET", Target: target})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if result.DNSLookup <= 0 {
+		t.Errorf("Got DNS lookup time %v, expected it to be measured", result.DNSLookup)
+	}
+}
+
+func TestDoProbeHTTPTrace(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	restore := main.SetHTTPTrace(true)
+	defer restore()
+
+	result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if result.Connect <= 0 || result.TLSHandshake <= 0 || result.FirstByte <= 0 {
+		t.Errorf("Got connect %v, TLS handshake %v, first byte %v, expected all to be measured", result.Connect, result.TLSHandshake, result.FirstByte)
+	}
+
+	out := probe(t, `{"a": 1}`, "")
+	for _, expected := range []string{"connect_seconds", "tls_handshake_seconds 0\n", "time_to_first_byte_seconds"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	restore()
+	out = probe(t, `{"a": 1}`, "")
+	if strings.Contains(out, "connect_seconds") {
+		t.Errorf("Expected no phase timings without tracing, got:\n%s", out)
+	}
+}
+
+func TestDoProbeHostOverride(t *testing.T) {
+	var gotHost, gotServerName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			gotServerName = hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := main.NewHTTPClient(main.ClientConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testData := []struct {
+		name       string
+		host       string
+		serverName string
+	}{
+		{name: "none"},
+		{name: "host", host: "api.example.com"},
+		{name: "host and server name", host: "api.example.com", serverName: "tls.example.com"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHost, gotServerName = "", ""
+			_, err := main.DoProbe(context.Background(), client, main.ProbeRequest{
+				Method:     "GET",
+				Target:     server.URL,
+				Host:       tt.host,
+				ServerName: tt.serverName,
+				Headers:    http.Header{"Connection": []string{"close"}},
+			})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			expectedHost := tt.host
+			if expectedHost == "" {
+				expectedHost = strings.TrimPrefix(server.URL, "https://")
+			}
+			if gotHost != expectedHost {
+				t.Errorf("Got Host %q, expected %q", gotHost, expectedHost)
+			}
+			if gotServerName != tt.serverName {
+				t.Errorf("Got server name %q, expected %q", gotServerName, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestDoProbeServerNameTransportsBounded(t *testing.T) {
+	var closed int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := main.NewHTTPClient(main.ClientConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := 5
+	for i := 0; i < main.MaxServerNames+extra; i++ {
+		_, err := main.DoProbe(context.Background(), client, main.ProbeRequest{
+			Method:     "GET",
+			Target:     server.URL,
+			ServerName: fmt.Sprintf("tls%d.example.com", i),
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if got := main.ServerNameTransports(client); got != main.MaxServerNames {
+		t.Errorf("Got %d transports, expected %d", got, main.MaxServerNames)
+	}
+	// The evicted transports close their idle connections.
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&closed) < int32(extra) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&closed); got != int32(extra) {
+		t.Errorf("Got %d closed connections, expected %d", got, extra)
+	}
+}
+func TestNewHTTPClientDNSServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := main.NewHTTPClient(main.ClientConfig{DNSServer: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go main.DoProbe(ctx, client, main.ProbeRequest{Method: "GET", Target: "http://target.example.com/"})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFrom(make([]byte, 512)); err != nil {
+		t.Errorf("Expected a query to the DNS server, got: %v", err)
+	}
+}
+
+// socks5Server starts a SOCKS5 proxy supporting CONNECT, requiring the
+// given credentials unless user is empty, and sends the address of every
+// connection it makes to targets.
+func socks5Server(t *testing.T, user, password string, targets chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(conn net.Conn) error {
+		defer conn.Close()
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return err
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return err
+		}
+		if user == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return err
+			}
+			u := make([]byte, b[1])
+			io.ReadFull(conn, u)
+			io.ReadFull(conn, b[:1])
+			p := make([]byte, b[0])
+			io.ReadFull(conn, p)
+			if string(u) != user || string(p) != password {
+				conn.Write([]byte{1, 1})
+				return errors.New("bad credentials")
+			}
+			conn.Write([]byte{1, 0})
+		}
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return err
+		}
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n := make([]byte, 1)
+			io.ReadFull(conn, n)
+			name := make([]byte, n[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return fmt.Errorf("unsupported address type %d", req[3])
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+		targets <- addr
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return err
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l
+}
+
+func TestNewHTTPClientSOCKS5Proxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
 	testData := []struct {
 		name     string
-		bytes    []byte
-		expected []kvPair
+		user     string
+		password string
+		proxy    func(addr string) string
+		valid    bool
+	}{
+		{name: "address", proxy: func(addr string) string { return addr }, valid: true},
+		{name: "credentials", user: "user", password: "secret", proxy: func(addr string) string { return "socks5://user:secret@" + addr }, valid: true},
+		{name: "wrong credentials", user: "user", password: "secret", proxy: func(addr string) string { return "socks5://user:wrong@" + addr }},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 10)
+			l := socks5Server(t, tt.user, tt.password, targets)
+			defer l.Close()
+
+			client, err := main.NewHTTPClient(main.ClientConfig{SOCKS5Proxy: tt.proxy(l.Addr().String())})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: target})
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			if result.StatusCode != http.StatusOK {
+				t.Errorf("Got status %d, expected %d", result.StatusCode, http.StatusOK)
+			}
+			// The proxy resolves the target's host name.
+			if got, expected := <-targets, strings.TrimPrefix(target, "http://"); got != expected {
+				t.Errorf("Got proxied address %q, expected %q", got, expected)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientSOCKS5ProxyInvalid(t *testing.T) {
+	for _, cfg := range []main.ClientConfig{
+		{SOCKS5Proxy: "127.0.0.1:1080", ProxyURL: "http://127.0.0.1:3128"},
+		{SOCKS5Proxy: "http://127.0.0.1:1080"},
+		{SOCKS5Proxy: "127.0.0.1"},
+	} {
+		if _, err := main.NewHTTPClient(cfg); err == nil {
+			t.Errorf("%+v: expected error", cfg)
+		}
+	}
+}
+
+func TestNewHTTPClientCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/start" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			http.Redirect(w, r, "/data", http.StatusFound)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name       string
+		cookieJar  bool
+		statusCode int
+	}{
+		{name: "stateless", cookieJar: false, statusCode: http.StatusUnauthorized},
+		{name: "cookie jar", cookieJar: true, statusCode: http.StatusOK},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := main.NewHTTPClient(main.ClientConfig{CookieJar: tt.cookieJar})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, _ := main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: server.URL + "/start"})
+			if result.StatusCode != tt.statusCode {
+				t.Errorf("Got status %d, expected %d", result.StatusCode, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientCertWithoutKey(t *testing.T) {
+	_, err := main.NewHTTPClient(main.ClientConfig{CertFile: "client.pem"})
+	if err == nil {
+		t.Errorf("Expected error when key file is missing")
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "json-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	testData := []struct {
+		name    string
+		content string
+		valid   bool
 	}{
 		{
-			name:  "float value",
-			bytes: []byte(`{"x": 1.0}`),
-			expected: []kvPair{
-				kvPair{key: "x", value: 1.0},
-			},
+			name: "valid",
+			content: `
+modules:
+  status:
+    prefix: status_
+    jsonpath: $.status
+    timeout: 5s
+    headers:
+      X-Api-Key: secret
+`,
+			valid: true,
 		},
 		{
-			name:  "int value",
-			bytes: []byte(`{"x": 1}`),
-			expected: []kvPair{
-				kvPair{key: "x", value: 1.0},
-			},
+			name: "unknown field",
+			content: `
+modules:
+  status:
+    prefixx: status_
+`,
+			valid: false,
 		},
 		{
-			name:  "bool value",
-			bytes: []byte(`{"x": true}`),
-			expected: []kvPair{
-				kvPair{key: "x", value: 1.0},
-			},
+			name: "help",
+			content: `
+modules:
+  status:
+    help:
+      - match: requests_*
+        help: Requests served
+`,
+			valid: true,
 		},
 		{
-			name:     "string value",
-			bytes:    []byte(`{"x": "ok"}`),
-			expected: nil,
+			name: "empty help",
+			content: `
+modules:
+  status:
+    help:
+      - match: requests_*
+        help: ""
+`,
+			valid: false,
 		},
 		{
-			name:     "null value",
-			bytes:    []byte(`{"x": null}`),
-			expected: nil,
+			name: "invalid help pattern",
+			content: `
+modules:
+  status:
+    help:
+      - match: "requests_["
+        help: Requests served
+`,
+			valid: false,
 		},
 		{
-			name:  "array value",
-			bytes: []byte(`{"x": [1, 2, 3]}`),
-			expected: []kvPair{
-				kvPair{key: "x__0", value: 1},
-				kvPair{key: "x__1", value: 2},
-				kvPair{key: "x__2", value: 3},
-			},
+			name: "invalid prefix",
+			content: `
+modules:
+  status:
+    prefix: status-api_
+`,
+			valid: false,
 		},
 		{
-			name:  "nested value",
-			bytes: []byte(`{"x": {"y": 1}}`),
-			expected: []kvPair{
-				kvPair{key: "x_y", value: 1.0},
-			},
+			name: "invalid prefix template",
+			content: `
+modules:
+  status:
+    prefix: "{{.Module"
+`,
+			valid: false,
 		},
 		{
-			name:  "nested^2 value",
-			bytes: []byte(`{"x": {"y": {"z": 1}}}`),
-			expected: []kvPair{
-				kvPair{key: "x_y_z", value: 1.0},
-			},
+			name: "invalid label name",
+			content: `
+modules:
+  status:
+    labels:
+      env-name: prod
+`,
+			valid: false,
 		},
 		{
-			name:  "array in nested value",
-			bytes: []byte(`{"x": {"y": [1, 2, 3]}}`),
-			expected: []kvPair{
-				kvPair{key: "x_y__0", value: 1},
-				kvPair{key: "x_y__1", value: 2},
-				kvPair{key: "x_y__2", value: 3},
-			},
+			name: "invalid transform",
+			content: `
+modules:
+  status:
+    jsonpaths:
+      - path: $.a
+        transform: "(. * 100"
+`,
+			valid: false,
 		},
 		{
-			name:  "array in array value",
-			bytes: []byte(`{"x": [[1, 2], [3, 4]]}`),
-			expected: []kvPair{
-				kvPair{key: "x__0__0", value: 1},
-				kvPair{key: "x__0__1", value: 2},
-				kvPair{key: "x__1__0", value: 3},
-				kvPair{key: "x__1__1", value: 4},
-			},
+			name: "unknown mode",
+			content: `
+modules:
+  status:
+    mode: size
+`,
+			valid: false,
+		},
+		{
+			name: "body and body file",
+			content: `
+modules:
+  status:
+    body: "{}"
+    body_file: /etc/body.json
+`,
+			valid: false,
+		},
+		{
+			name: "invalid rewrite pattern",
+			content: `
+modules:
+  status:
+    rewrites:
+      - match: "data_("
+        replacement: data
+`,
+			valid: false,
+		},
+		{
+			name: "state set without values",
+			content: `
+modules:
+  status:
+    states:
+      - name: state
+        path: $.state
+`,
+			valid: false,
+		},
+		{
+			name: "invalid content type",
+			content: `
+modules:
+  status:
+    body: a=1
+    content_type: form
+`,
+			valid: false,
+		},
+		{
+			name: "base64 path without member",
+			content: `
+modules:
+  status:
+    base64_paths:
+      - $.values[*]
+`,
+			valid: false,
+		},
+		{
+			name: "unknown metric type",
+			content: `
+modules:
+  status:
+    types:
+      - match: "*_total"
+        type: histogram
+`,
+			valid: false,
+		},
+		{
+			name: "sigv4 without service",
+			content: `
+modules:
+  status:
+    sigv4:
+      region: eu-west-1
+      access_key: AKID
+      secret_key: secret
+`,
+			valid: false,
+		},
+		{
+			name: "pagination without next page",
+			content: `
+modules:
+  status:
+    pagination:
+      items_path: $.items
+`,
+			valid: false,
+		},
+		{
+			name: "unit conversion without scale",
+			content: `
+modules:
+  status:
+    units:
+      - suffix: days
+        unit: seconds
+`,
+			valid: false,
+		},
+		{
+			name: "login without url",
+			content: `
+modules:
+  status:
+    login:
+      body: '{"user": "u"}'
+`,
+			valid: false,
+		},
+		{
+			name: "invalid target template",
+			content: `
+modules:
+  status:
+    target: "https://api/{{.id/status"
+`,
+			valid: false,
+		},
+		{
+			name: "negative timeout",
+			content: `
+modules:
+  status:
+    timeout: -5s
+`,
+			valid: false,
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTempFile(t, tt.content)
+			defer os.Remove(path)
+
+			_, err := main.LoadConfig(path)
+			if (err == nil) != tt.valid {
+				t.Errorf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestDoProbeMethodAndBody(t *testing.T) {
+	var gotMethod, gotBody, gotContentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotContentType = r.Header.Get("Content-Type")
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name               string
+		method             string
+		body               string
+		requestContentType string
+		contentType        string
+	}{
+		{name: "get", method: "GET", body: "", contentType: ""},
+		{name: "post", method: "POST", body: `{"query": "{ x }"}`, contentType: "application/json"},
+		{name: "graphql", method: "POST", body: `{ x }`, requestContentType: "application/graphql", contentType: "application/graphql"},
+		{name: "get with content type", method: "GET", body: "", requestContentType: "application/graphql", contentType: ""},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: tt.method, Target: server.URL, Body: tt.body, ContentType: tt.requestContentType})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if gotMethod != tt.method || gotBody != tt.body || gotContentType != tt.contentType {
+				t.Errorf("Got: %s %q %q, expected: %s %q %q", gotMethod, gotBody, gotContentType, tt.method, tt.body, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestIsJSONContentType(t *testing.T) {
+	testData := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"application/problem+json", true},
+		{"text/html; charset=utf-8", false},
+		{"text/plain", false},
+		{"", false},
+	}
+
+	for _, tt := range testData {
+		if got := main.IsJSONContentType(tt.contentType); got != tt.expected {
+			t.Errorf("%q: got %v, expected %v", tt.contentType, got, tt.expected)
+		}
+	}
+}
+
+func TestDoProbeMaxResponseBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"x": "` + strings.Repeat("a", 1024) + `"}`))
+	}))
+	defer server.Close()
+
+	restore := main.SetMaxResponseBytes(512)
+	defer restore()
+
+	_, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL})
+	if !errors.Is(err, main.ErrResponseTooLarge) {
+		t.Errorf("Got error: %v, expected: %v", err, main.ErrResponseTooLarge)
+	}
+}
+
+func probe(t *testing.T, body string, query string) string {
+	return probeStatus(t, http.StatusOK, body, query)
+}
+
+func probeStatus(t *testing.T, status int, body string, query string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL)+query, nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+func TestProbeHandlerNameCollision(t *testing.T) {
+	out := probe(t, `{"a b": 1, "a/b": 2}`, "")
+	if !strings.Contains(out, "metric_name_collisions 1") {
+		t.Errorf("Expected one collision, got:\n%s", out)
+	}
+	if !strings.Contains(out, "up 1") {
+		t.Errorf("Expected up 1, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerExporterMetricNames(t *testing.T) {
+	out := probe(t, `{"up": 0, "scrape_duration_seconds": 5, "http_status_code": 500, "json_values": 9, "a": 1}`, "")
+	for _, expected := range []string{"up 1", "http_status_code 200", "json_values 1", "metric_name_collisions 4", "a 1"} {
+		if !strings.Contains(out, "\n"+expected+"\n") {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "\nscrape_duration_seconds 5\n") {
+		t.Errorf("Expected the probe duration, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerCollisionSuffix(t *testing.T) {
+	restore := main.SetCollisionSuffix(true)
+	defer restore()
+
+	out := probe(t, `{"a b": 1, "a/b": 2, "a-b": 3, "a_b_1": 4}`, "")
+	for _, expected := range []string{"a_b 1", "a_b_1 3", "a_b_2 2", "a_b_1_1 4", "metric_name_collisions 3"} {
+		if !strings.Contains(out, "\n"+expected+"\n") {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestDoProbeBasicAuth(t *testing.T) {
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	tokenFile := writeTempFile(t, "token-from-file\n")
+	defer os.Remove(tokenFile)
+
+	testData := []struct {
+		name     string
+		request  main.ProbeRequest
+		expected string
+	}{
+		{
+			name:     "no auth",
+			request:  main.ProbeRequest{},
+			expected: "",
+		},
+		{
+			name:     "basic auth",
+			request:  main.ProbeRequest{Username: "user", Password: "pass"},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+		{
+			name:     "bearer token file",
+			request:  main.ProbeRequest{BearerTokenFile: tokenFile, Username: "user"},
+			expected: "Bearer token-from-file",
 		},
 		{
-			name:  "array at root",
-			bytes: []byte(`[1, 2, 3]`),
-			expected: []kvPair{
-				kvPair{key: "__0", value: 1},
-				kvPair{key: "__1", value: 2},
-				kvPair{key: "__2", value: 3},
+			name: "header wins",
+			request: main.ProbeRequest{
+				Username: "user",
+				Password: "pass",
+				Headers:  http.Header{"Authorization": []string{"Bearer token"}},
 			},
+			expected: "Bearer token",
 		},
 	}
 
 	for _, tt := range testData {
 		t.Run(tt.name, func(t *testing.T) {
-			var jsonData interface{}
-			err := json.Unmarshal(tt.bytes, &jsonData)
+			tt.request.Method = "GET"
+			tt.request.Target = server.URL
+			_, err := main.DoProbe(context.Background(), server.Client(), tt.request)
 			if err != nil {
-				t.Errorf("Error: %v", err)
+				t.Fatalf("Error: %v", err)
+			}
+			if gotAuth != tt.expected {
+				t.Errorf("Got: %q, expected: %q", gotAuth, tt.expected)
 			}
+		})
+	}
+}
 
-			r := &receiver{}
-			main.WalkJSON("", jsonData, r)
-			if !reflect.DeepEqual(r.received, tt.expected) {
-				t.Errorf("Got: %#v, expected: %#v", r.received, tt.expected)
+func TestDoProbeMissingBearerTokenFile(t *testing.T) {
+	_, err := main.DoProbe(context.Background(), http.DefaultClient, main.ProbeRequest{
+		Method:          "GET",
+		Target:          "http://127.0.0.1:0",
+		BearerTokenFile: "/nonexistent/token",
+	})
+	if err == nil {
+		t.Errorf("Expected error for missing token file")
+	}
+}
+
+func TestDoProbeBodyFile(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = string(body)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	bodyFile := writeTempFile(t, `{"query": "first"}`)
+	defer os.Remove(bodyFile)
+	preq := main.ProbeRequest{Method: "POST", Target: server.URL, BodyFile: bodyFile}
+	for _, expected := range []string{`{"query": "first"}`, `{"query": "second"}`} {
+		if err := ioutil.WriteFile(bodyFile, []byte(expected), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := main.DoProbe(context.Background(), server.Client(), preq); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if got != expected {
+			t.Errorf("Got body %q, expected %q", got, expected)
+		}
+	}
+
+	preq.BodyFile = "/nonexistent/body.json"
+	if _, err := main.DoProbe(context.Background(), server.Client(), preq); err == nil {
+		t.Errorf("Expected error for missing body file")
+	}
+}
+
+func TestProbeHandlerMultipleJSONPaths(t *testing.T) {
+	out := probe(t, `{"a": {"x": 1}, "b": [2]}`, "&jsonpath="+url.QueryEscape("first=$.a")+"&jsonpath="+url.QueryEscape("second=$.b")+"&jsonpath="+url.QueryEscape("missing=$.c"))
+	for _, expected := range []string{"first_x 1", "second_0 2", "jsonpath_found 0", "up 1"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestProbeHandlerJSONPathNotFound(t *testing.T) {
+	out := probe(t, `{"a": 1}`, "&jsonpath="+url.QueryEscape("$.b"))
+	for _, expected := range []string{"jsonpath_found 0", "up 1"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestProbeHandlerJQ(t *testing.T) {
+	out := probe(t, `{"a": {"x": 1}, "b": {"y": 2}}`, "&jq="+url.QueryEscape(".a, .b")+"&jsonpath="+url.QueryEscape("$.a"))
+	for _, expected := range []string{"_0_x 1", "_1_y 2", "up 1"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "jsonpath_found") {
+		t.Errorf("Expected jsonpath to be ignored, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerInvalidJQ(t *testing.T) {
+	req := httptest.NewRequest("GET", "/probe?target=http://127.0.0.1:0&jq="+url.QueryEscape("(.a"), nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestProbeHandlerMaxConcurrentProbes(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	restore := main.SetMaxConcurrentProbes(1)
+	defer restore()
+
+	done := make(chan struct{})
+	go func() {
+		req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+		main.ProbeHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	<-started
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	close(release)
+	<-done
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d, expected %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header")
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	var jsonData interface{}
+	jsonErr := json.Unmarshal([]byte(`<html>`), &jsonData)
+
+	testData := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{"timeout", context.DeadlineExceeded, "timeout"},
+		{"bad json", jsonErr, "bad-json"},
+		{"too large", main.ErrResponseTooLarge, "too-large"},
+		{"empty", main.ErrEmptyResponse, "empty"},
+		{"other", errors.New("connection refused"), "other"},
+	}
+
+	for _, tt := range testData {
+		if got := main.FailureReason(tt.err); got != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestDoProbeCompressedResponse(t *testing.T) {
+	testData := []struct {
+		encoding string
+		compress func(w io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.encoding, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.encoding)
+				cw := tt.compress(w)
+				cw.Write([]byte(`{"x": 1}`))
+				cw.Close()
+			}))
+			defer server.Close()
+
+			result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{
+				Method:  "GET",
+				Target:  server.URL,
+				Headers: http.Header{"Accept-Encoding": []string{"identity"}},
+			})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			expected := map[string]interface{}{"x": json.Number("1")}
+			if !reflect.DeepEqual(result.Data, expected) {
+				t.Errorf("Got: %#v, expected: %#v", result.Data, expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeAcceptEncoding(t *testing.T) {
+	// {"a": 1, "b": 2} compressed with brotli.
+	fixture, _ := hex.DecodeString("8b07807b2261223a20312c202262223a20327d03")
+	testData := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "brotli", encoding: "br", body: fixture},
+		{name: "unknown", encoding: "x-custom", body: []byte(`{"a": 1, "b": 2}`)},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			var accepted string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accepted = r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Encoding", tt.encoding)
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL})
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if accepted != "gzip, br" {
+				t.Errorf("Got Accept-Encoding %q, expected gzip, br", accepted)
+			}
+			expected := map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")}
+			if !reflect.DeepEqual(result.Data, expected) {
+				t.Errorf("Got: %#v, expected: %#v", result.Data, expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerContentLength(t *testing.T) {
+	testData := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "json", body: `{"a": 1}`, expected: "content_length_bytes 8"},
+		{name: "empty", body: ``, expected: "content_length_bytes 0"},
+		{name: "invalid", body: `{"a": `, expected: "content_length_bytes 6"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, tt.body, "")
+			if !strings.Contains(out, tt.expected+"\n") {
+				t.Errorf("Expected %s, got:\n%s", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerJSONParseSuccess(t *testing.T) {
+	testData := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{name: "json", body: `{"a": 1}`, expected: []string{"json_parse_success 1", "up 1"}},
+		{name: "invalid", body: `{"a": `, expected: []string{"json_parse_success 0", "up 1"}},
+		{name: "html", body: `<html>`, expected: []string{"json_parse_success 0", "empty_response 0", "up 1"}},
+		{name: "empty", body: ``, expected: []string{"empty_response 1", "up 1"}},
+		{name: "whitespace", body: " \n", expected: []string{"empty_response 1", "up 1"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, tt.body, "")
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/probe?target=http://127.0.0.1:0", nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		out := rec.Body.String()
+		if !strings.Contains(out, "up 0\n") || strings.Contains(out, "json_parse_success") {
+			t.Errorf("Expected up 0 without json_parse_success, got:\n%s", out)
+		}
+	})
+}
+
+func TestProbeHandlerValueCounts(t *testing.T) {
+	testData := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{name: "numbers", body: `{"a": 1, "b": [2, 3]}`, expected: []string{"json_values 3", "json_keys_ignored 0"}},
+		{name: "strings and nulls", body: `{"a": 1, "b": "x", "c": null}`, expected: []string{"json_values 1", "json_keys_ignored 2"}},
+		{name: "empty", body: `{}`, expected: []string{"json_values 0", "json_keys_ignored 0"}},
+		{name: "precision loss", body: `{"id": 12345678901234567891, "a": 0.1, "b": 9007199254740993}`, expected: []string{"json_values 3", "precision_loss 2"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, tt.body, "")
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "exporter.sock")
+
+	tcpListener, err := main.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixListener, err := main.Listen("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- main.Serve(ctx, &http.Server{Handler: main.NewMux()}, []net.Listener{tcpListener, unixListener}, time.Second)
+	}()
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for _, client := range []*http.Client{http.DefaultClient, unixClient} {
+		resp, err := client.Get("http://" + tcpListener.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Got status %d, expected %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Server did not shut down")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed, got: %v", err)
+	}
+}
+
+func TestDoProbeCancelDuringBody(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": `))
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := main.DoProbe(ctx, server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Probe returned after %v, expected it to return once the context was done", elapsed)
+	}
+}
+
+func TestDoProbeRetries(t *testing.T) {
+	testData := []struct {
+		name       string
+		method     string
+		failures   int
+		retries    int
+		statusCode int
+	}{
+		{name: "recovers", method: "GET", failures: 2, retries: 2, statusCode: http.StatusOK},
+		{name: "gives up", method: "GET", failures: 5, retries: 3, statusCode: http.StatusServiceUnavailable},
+		{name: "post not retried", method: "POST", failures: 1, retries: 0, statusCode: http.StatusServiceUnavailable},
+	}
+
+	restore := main.SetProbeRetries(3)
+	defer restore()
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			result, _ := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: tt.method, Target: server.URL})
+			if result.Retries != tt.retries || result.StatusCode != tt.statusCode {
+				t.Errorf("Got %d retries and status %d, expected %d and %d", result.Retries, result.StatusCode, tt.retries, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestDoProbeRetryAfter(t *testing.T) {
+	testData := []struct {
+		name        string
+		respect     bool
+		retryAfter  string
+		timeout     time.Duration
+		retries     int
+		statusCode  int
+		rateLimited bool
+	}{
+		{name: "seconds", respect: true, retryAfter: "0", retries: 1, statusCode: http.StatusOK},
+		{name: "date", respect: true, retryAfter: "Mon, 02 Jan 2006 15:04:05 GMT", retries: 1, statusCode: http.StatusOK},
+		{name: "no header", respect: true, statusCode: http.StatusTooManyRequests, rateLimited: true},
+		{name: "past deadline", respect: true, retryAfter: "3600", timeout: time.Second, statusCode: http.StatusTooManyRequests, rateLimited: true},
+		{name: "not respected", retryAfter: "0", statusCode: http.StatusTooManyRequests},
+	}
+
+	restore := main.SetProbeRetries(3)
+	defer restore()
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			defer main.SetRespectRetryAfter(tt.respect)()
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts == 1 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+				w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			result, _ := main.DoProbe(ctx, server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL})
+			if result.Retries != tt.retries || result.StatusCode != tt.statusCode || result.RateLimited != tt.rateLimited {
+				t.Errorf("Got %d retries, status %d and rate limited %v, expected %d, %d and %v", result.Retries, result.StatusCode, result.RateLimited, tt.retries, tt.statusCode, tt.rateLimited)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Probe took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	testData := []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{"Tue, 02 Jan 2024 15:05:05 GMT", time.Minute, true},
+		{"Tue, 02 Jan 2024 15:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range testData {
+		got, ok := main.RetryAfter(tt.value, now)
+		if got != tt.expected || ok != tt.valid {
+			t.Errorf("%q: got %v and %v, expected %v and %v", tt.value, got, ok, tt.expected, tt.valid)
+		}
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	defer main.SetTimeoutOffset(500 * time.Millisecond)()
+
+	testData := []struct {
+		value    string
+		expected time.Duration
+		valid    bool
+	}{
+		{"10", 9500 * time.Millisecond, true},
+		{"0.55", 100 * time.Millisecond, true},
+		{"0.2", 100 * time.Millisecond, true},
+		{"", 0, false},
+		{"0", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range testData {
+		req := httptest.NewRequest("GET", "/probe", nil)
+		if tt.value != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.value)
+		}
+		got, ok := main.ScrapeTimeout(req)
+		if got != tt.expected || ok != tt.valid {
+			t.Errorf("%q: got %v and %v, expected %v and %v", tt.value, got, ok, tt.expected, tt.valid)
+		}
+	}
+}
+
+func TestProbeHandlerRateLimited(t *testing.T) {
+	defer main.SetRespectRetryAfter(true)()
+	out := probeStatus(t, http.StatusTooManyRequests, `{}`, "")
+	for _, expected := range []string{"rate_limited 1", "http_status_code 429", "up 0"} {
+		if !strings.Contains(out, expected+"\n") {
+			t.Errorf("Expected %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestProbeHandlerCircuitBreaker(t *testing.T) {
+	testData := []struct {
+		name     string
+		statuses []int
+		hits     int
+		expected string
+	}{
+		{name: "opens", statuses: []int{503, 503, 200, 200}, hits: 2, expected: "circuit_open 1"},
+		{name: "success resets", statuses: []int{503, 200, 503, 200}, hits: 4, expected: "circuit_open 0"},
+		{name: "below threshold", statuses: []int{503}, hits: 1, expected: "circuit_open 0"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetCircuitBreaker(2, time.Hour)
+			defer restore()
+
+			hits := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[hits])
+				hits++
+				w.Write([]byte(`{"a": 1}`))
+			}))
+			defer server.Close()
+
+			var out string
+			for range tt.statuses {
+				req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+				rec := httptest.NewRecorder()
+				main.ProbeHandler(rec, req)
+				out = rec.Body.String()
+			}
+			if hits != tt.hits {
+				t.Errorf("Target was probed %d times, expected %d", hits, tt.hits)
+			}
+			if !strings.Contains(out, tt.expected+"\n") {
+				t.Errorf("Expected %s, got:\n%s", tt.expected, out)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerLastSuccess(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	lastSuccess := func() string {
+		req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "last_success_timestamp_seconds ") {
+				return strings.TrimPrefix(line, "last_success_timestamp_seconds ")
+			}
+		}
+		return ""
+	}
+
+	if got := lastSuccess(); got != "" {
+		t.Errorf("Got last success %s before any success", got)
+	}
+	status = http.StatusOK
+	before := float64(time.Now().Unix())
+	succeeded := lastSuccess()
+	if ts, err := strconv.ParseFloat(succeeded, 64); err != nil || ts < before {
+		t.Errorf("Got last success %q, expected a time after %v", succeeded, before)
+	}
+	status = http.StatusServiceUnavailable
+	if got := lastSuccess(); got != succeeded {
+		t.Errorf("Got last success %q after a failure, expected %q", got, succeeded)
+	}
+}
+
+func TestProbeHandlerStatusCode(t *testing.T) {
+	testData := []struct {
+		status      int
+		failOnError bool
+		expected    []string
+		notExpected []string
+	}{
+		{http.StatusOK, true, []string{"http_status_code 200", "up 1", "error 1"}, nil},
+		{http.StatusForbidden, true, []string{"http_status_code 403", "up 0"}, []string{"error 1"}},
+		{http.StatusNotFound, false, []string{"http_status_code 404", "up 0", "error 1"}, nil},
+	}
+
+	for _, tt := range testData {
+		restore := main.SetFailOnErrorStatus(tt.failOnError)
+		out := probeStatus(t, tt.status, `{"error": 1}`, "")
+		restore()
+		for _, expected := range tt.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("%d: expected %q, got:\n%s", tt.status, expected, out)
+			}
+		}
+		for _, notExpected := range tt.notExpected {
+			if strings.Contains(out, notExpected+"\n") {
+				t.Errorf("%d: unexpected %q, got:\n%s", tt.status, notExpected, out)
+			}
+		}
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	var codes main.StatusCodes
+	if err := codes.Set("200-299, 304"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for code, expected := range map[int]bool{200: true, 204: true, 304: true, 301: false, 404: false} {
+		if got := codes.Contains(code); got != expected {
+			t.Errorf("%d: got %v, expected %v", code, got, expected)
+		}
+	}
+	for _, invalid := range []string{"", "abc", "299-200"} {
+		if err := codes.Set(invalid); err == nil {
+			t.Errorf("%q: expected error", invalid)
+		}
+	}
+}
+
+func TestDoProbeRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/older", http.StatusFound))
+	mux.Handle("/older", http.RedirectHandler("/new", http.StatusMovedPermanently))
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	testData := []struct {
+		name       string
+		cfg        main.ClientConfig
+		statusCode int
+		redirects  int
+	}{
+		{"follow", main.ClientConfig{}, http.StatusOK, 2},
+		{"no follow", main.ClientConfig{NoFollowRedirects: true}, http.StatusFound, 0},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := main.NewHTTPClient(tt.cfg)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			result, _ := main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: server.URL + "/old"})
+			if result.StatusCode != tt.statusCode || result.Redirects != tt.redirects {
+				t.Errorf("Got status %d after %d redirects, expected %d after %d", result.StatusCode, result.Redirects, tt.statusCode, tt.redirects)
+			}
+		})
+	}
+}
+
+func TestRunTestFile(t *testing.T) {
+	path := writeTempFile(t, `{"stats": {"requests": 10}, "other": 1}`)
+	defer os.Remove(path)
+
+	client, _ := main.NewHTTPClient(main.ClientConfig{AllowFileTargets: true})
+	restore := main.SetHTTPClient(client)
+	defer restore()
+
+	var out bytes.Buffer
+	err := main.RunTestFile(path, "jsonpath="+url.QueryEscape("$.stats")+"&prefix=app_", &out)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []string{"app_requests 10", "app_up 1"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q, got:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "app_other") {
+		t.Errorf("Unexpected app_other, got:\n%s", out.String())
+	}
+}
+
+func TestRunTestFileInvalidParams(t *testing.T) {
+	path := writeTempFile(t, `{"x": 1}`)
+	defer os.Remove(path)
+
+	client, _ := main.NewHTTPClient(main.ClientConfig{AllowFileTargets: true})
+	restore := main.SetHTTPClient(client)
+	defer restore()
+
+	var out bytes.Buffer
+	err := main.RunTestFile(path, "prefix=0-bad", &out)
+	if err == nil || !strings.Contains(err.Error(), "probe failed") {
+		t.Errorf("Got error %v, expected the probe to fail", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected no output, got:\n%s", out.String())
+	}
+}
+
+func TestDoProbeFileTarget(t *testing.T) {
+	path := writeTempFile(t, `{"x": 1}`)
+	defer os.Remove(path)
+	target := (&url.URL{Scheme: "file", Path: path}).String()
+
+	client, _ := main.NewHTTPClient(main.ClientConfig{})
+	if _, err := main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: target}); err == nil {
+		t.Errorf("Expected file targets to be rejected by default")
+	}
+
+	client, _ = main.NewHTTPClient(main.ClientConfig{AllowFileTargets: true})
+	result, err := main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: target})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := map[string]interface{}{"x": json.Number("1")}
+	if !reflect.DeepEqual(result.Data, expected) {
+		t.Errorf("Got: %#v, expected: %#v", result.Data, expected)
+	}
+}
+
+func TestProbeHandlerTargetAllowlist(t *testing.T) {
+	restore := main.SetTargetAllowlist(regexp.MustCompile(`^(?:.*\.example\.com)$`))
+	defer restore()
+
+	testData := []struct {
+		target   string
+		expected int
+	}{
+		{"http://internal.local/status", http.StatusForbidden},
+		{"http://example.com.evil.org/status", http.StatusForbidden},
+		{"http://user@169.254.169.254/latest", http.StatusForbidden},
+	}
+
+	for _, tt := range testData {
+		req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(tt.target), nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		if rec.Code != tt.expected {
+			t.Errorf("%s: got status %d, expected %d", tt.target, rec.Code, tt.expected)
+		}
+	}
+}
+
+func TestNewHTTPClientBlockPrivateIPs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := main.NewHTTPClient(main.ClientConfig{BlockPrivateIPs: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Errorf("Expected connection to loopback address to be refused")
+	}
+}
+
+func TestNewHTTPClientBlockPrivateIPsProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	testData := []struct {
+		name        string
+		cfg         main.ClientConfig
+		moduleProxy *url.URL
+		target      string
+		valid       bool
+	}{
+		{name: "public target", cfg: main.ClientConfig{ProxyURL: proxy.URL}, target: "http://192.0.2.1/status", valid: true},
+		{name: "private target", cfg: main.ClientConfig{ProxyURL: proxy.URL}, target: "http://10.1.2.3/status"},
+		{name: "loopback host name", cfg: main.ClientConfig{ProxyURL: proxy.URL}, target: "http://localhost/status"},
+		{name: "module proxy", moduleProxy: proxyURL, target: "http://192.0.2.1/module", valid: true},
+		{name: "module proxy private target", moduleProxy: proxyURL, target: "http://10.1.2.3/module"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied = nil
+			tt.cfg.BlockPrivateIPs = true
+			client, err := main.NewHTTPClient(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: tt.target, ProxyURL: tt.moduleProxy})
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if !tt.valid {
+				if len(proxied) != 0 {
+					t.Errorf("Got proxied requests %q, expected none", proxied)
+				}
+				return
+			}
+			if len(proxied) != 1 || proxied[0] != tt.target {
+				t.Errorf("Got proxied requests %q, expected %q", proxied, tt.target)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientBlockPrivateIPsSOCKS5Proxy(t *testing.T) {
+	testData := []struct {
+		name   string
+		target string
+		valid  bool
+	}{
+		{name: "public target", target: "192.0.2.1:80", valid: true},
+		{name: "private target", target: "10.1.2.3:80"},
+		{name: "loopback host name", target: "localhost:80"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 10)
+			l := socks5Server(t, "", "", targets)
+			defer l.Close()
+
+			client, err := main.NewHTTPClient(main.ClientConfig{SOCKS5Proxy: l.Addr().String(), BlockPrivateIPs: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The public target is not reachable, only its address as
+			// received by the proxy is checked.
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err = main.DoProbe(ctx, client, main.ProbeRequest{Method: "GET", Target: "http://" + tt.target + "/"})
+			if !tt.valid {
+				if err == nil || !strings.Contains(err.Error(), "not allowed") {
+					t.Errorf("Got error %v, expected the target to be refused", err)
+				}
+				select {
+				case got := <-targets:
+					t.Errorf("Got proxied address %q, expected none", got)
+				default:
+				}
+				return
+			}
+			select {
+			case got := <-targets:
+				if got != tt.target {
+					t.Errorf("Got proxied address %q, expected %q", got, tt.target)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("Expected the proxy to be asked for %s, got error %v", tt.target, err)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte(`{"x": 1}`))
+	}))
+	defer proxy.Close()
+
+	client, err := main.NewHTTPClient(main.ClientConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err = main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: "http://json.example.com/status"})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if proxied != "http://json.example.com/status" {
+		t.Errorf("Got proxied request %q, expected %q", proxied, "http://json.example.com/status")
+	}
+
+	proxied = ""
+	moduleProxy, _ := url.Parse(proxy.URL)
+	client, _ = main.NewHTTPClient(main.ClientConfig{ProxyURL: "http://127.0.0.1:1"})
+	_, err = main.DoProbe(context.Background(), client, main.ProbeRequest{Method: "GET", Target: "http://json.example.com/module", ProxyURL: moduleProxy})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if proxied != "http://json.example.com/module" {
+		t.Errorf("Got proxied request %q, expected %q", proxied, "http://json.example.com/module")
+	}
+}
+
+func TestProbeHandlerSkipsNaN(t *testing.T) {
+	restore := main.SetWalker(&jsonexporter.Walker{ParseStringNumbers: true})
+	defer restore()
+
+	out := probe(t, `{"a": "NaN", "b": "+Inf", "c": "1"}`, "")
+	if strings.Contains("\n"+out, "\na ") || strings.Contains("\n"+out, "\nb ") {
+		t.Errorf("Expected NaN and Inf to be skipped, got:\n%s", out)
+	}
+	if !strings.Contains(out, "c 1") {
+		t.Errorf("Expected c 1, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerStaticLabels(t *testing.T) {
+	out := probe(t, `{"a": 1}`, "&label=env=prod&label=service=billing")
+	for _, expected := range []string{
+		`a{env="prod",service="billing"} 1`,
+		`up{env="prod",service="billing"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+
+	for _, label := range []string{"env", "0env=prod", "__env=prod", "e-nv=prod"} {
+		req := httptest.NewRequest("GET", "/probe?target=http://localhost&label="+url.QueryEscape(label), nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Label %q: got status %d, expected %d", label, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestProbeHandlerLabelField(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  items:
+    jsonpaths:
+      - path: $.items
+        label_field: name
+        value_field: value
+      - name: nested
+        path: $.items
+        label_field: meta.id
+        label: id
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"items": [
+		{"name": "a", "value": 1, "meta": {"id": 7}},
+		{"name": "b", "value": 2, "meta": {"id": 8}},
+		{"value": 3}
+	]}`, "&module=items")
+	for _, expected := range []string{
+		`value{name="a"} 1`,
+		`value{name="b"} 2`,
+		`nested_value{id="7"} 1`,
+		`nested_value{id="8"} 2`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, " 3\n") {
+		t.Errorf("Expected element without label field to be skipped, got:\n%s", out)
+	}
+}
+
+func TestDoProbeYAML(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		format      string
+	}{
+		{name: "content type", contentType: "application/yaml"},
+		{name: "format", contentType: "text/plain", format: "yaml"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte("status:\n  ok: true\n  count: 3\n  ratio: 0.5\n"))
+			}))
+			defer server.Close()
+
+			result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL, Format: tt.format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &receiver{}
+			jsonexporter.WalkJSON("", result.Data, r)
+			got := map[string]float64{}
+			for _, kv := range r.received {
+				got[kv.key] = kv.value
+			}
+			expected := map[string]float64{"status_ok": 1, "status_count": 3, "status_ratio": 0.5}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("Got: %#v, expected: %#v", got, expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeNDJSON(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		format      string
+		body        string
+		expected    map[string]float64
+		valid       bool
+	}{
+		{
+			name:        "content type",
+			contentType: "application/x-ndjson",
+			body:        "{\"a\": 1}\n{\"a\": 2}\n",
+			expected:    map[string]float64{"__0_a": 1, "__1_a": 2},
+			valid:       true,
+		},
+		{
+			name:        "format with blank lines",
+			contentType: "text/plain",
+			format:      "ndjson",
+			body:        "\n{\"a\": 1}\n\n  \n{\"b\": 3}",
+			expected:    map[string]float64{"__0_a": 1, "__1_b": 3},
+			valid:       true,
+		},
+		{
+			name:   "empty",
+			format: "ndjson",
+			body:   "",
+			valid:  true,
+		},
+		{
+			name:   "invalid line",
+			format: "ndjson",
+			body:   "{\"a\": 1}\n{\"a\": \n",
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL, Format: tt.format})
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			r := &receiver{}
+			jsonexporter.WalkJSON("", result.Data, r)
+			var got map[string]float64
+			for _, kv := range r.received {
+				if got == nil {
+					got = map[string]float64{}
+				}
+				got[kv.key] = kv.value
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDoProbeXML(t *testing.T) {
+	testData := []struct {
+		name        string
+		contentType string
+		format      string
+		body        string
+		expected    map[string]float64
+		valid       bool
+	}{
+		{
+			name:   "nested",
+			format: "xml",
+			body: `<?xml version="1.0"?>
+<status xmlns="urn:example" version="2">
+  <uptime>3600</uptime>
+  <queue name="jobs" size="5"><workers>3</workers></queue>
+  <disk>10</disk>
+  <disk>20.5</disk>
+  <note>fine</note>
+  <load unit="percent">42</load>
+</status>`,
+			expected: map[string]float64{
+				"status_version":       2,
+				"status_uptime":        3600,
+				"status_queue_size":    5,
+				"status_queue_workers": 3,
+				"status_disk__0":       10,
+				"status_disk__1":       20.5,
+				"status_load_text":     42,
+			},
+			valid: true,
+		},
+		{
+			name:        "content type",
+			contentType: "application/xml",
+			body:        `<feed><count>1</count></feed>`,
+		},
+		{
+			name:        "suffix content type",
+			contentType: "application/atom+xml",
+			body:        `<feed><count>1</count></feed>`,
+		},
+		{
+			name:        "format",
+			contentType: "text/plain",
+			format:      "xml",
+			body:        `<a><b>-1e3</b><c>01</c></a>`,
+			expected:    map[string]float64{"a_b": -1000},
+			valid:       true,
+		},
+		{
+			name:   "unclosed",
+			format: "xml",
+			body:   `<a><b>1</b>`,
+		},
+		{
+			name:   "empty",
+			format: "xml",
+			body:   ``,
+		},
+		{
+			name:   "too deep",
+			format: "xml",
+			body:   strings.Repeat("<a>", 100000) + "1" + strings.Repeat("</a>", 100000),
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL, Format: tt.format})
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			r := &receiver{}
+			jsonexporter.WalkJSON("", result.Data, r)
+			got := map[string]float64{}
+			for _, kv := range r.received {
+				got[kv.key] = kv.value
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Got: %#v, expected: %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerOpenMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name        string
+		enable      bool
+		contentType string
+	}{
+		{name: "disabled", enable: false, contentType: "text/plain"},
+		{name: "enabled", enable: true, contentType: "application/openmetrics-text"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetEnableOpenMetrics(tt.enable)
+			defer restore()
+
+			req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Got Content-Type %q, expected %s", got, tt.contentType)
+			}
+			out := rec.Body.String()
+			for _, expected := range []string{"a 1", "up 1", "scrape_duration_seconds"} {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestDoProbeCache(t *testing.T) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name     string
+		ttl      time.Duration
+		paths    []string
+		expected map[string]int
+	}{
+		{name: "hit", ttl: time.Minute, paths: []string{"/a", "/a"}, expected: map[string]int{"/a": 1}},
+		{name: "expired", ttl: time.Nanosecond, paths: []string{"/a", "/a"}, expected: map[string]int{"/a": 2}},
+		{name: "evicted", ttl: time.Minute, paths: []string{"/a", "/b", "/c", "/a"}, expected: map[string]int{"/a": 2, "/b": 1, "/c": 1}},
+		{name: "recently used", ttl: time.Minute, paths: []string{"/a", "/b", "/a", "/c", "/a"}, expected: map[string]int{"/a": 1, "/b": 1, "/c": 1}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetCache(tt.ttl, 2)
+			defer restore()
+			requests = map[string]int{}
+
+			for _, path := range tt.paths {
+				result, err := main.DoProbe(context.Background(), server.Client(), main.ProbeRequest{Method: "GET", Target: server.URL + path})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Data == nil {
+					t.Fatalf("Got no data for %s", path)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if !reflect.DeepEqual(requests, tt.expected) {
+				t.Errorf("Got requests: %v, expected: %v", requests, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerHelp(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  help:
+    help:
+      - match: requests_total
+        help: Total requests served
+      - match: requests_*
+        help: Requests by outcome
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"requests": {"total": 3, "failed": 1}, "other": 2}`, "&module=help")
+	for _, expected := range []string{
+		"# HELP requests_total Total requests served",
+		"# HELP requests_failed Requests by outcome",
+		"# HELP other Retrieved value",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestProbeHandlerQuery(t *testing.T) {
+	var gotQuery url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		name     string
+		target   string
+		query    []string
+		status   int
+		expected url.Values
+	}{
+		{name: "added", target: "/", query: []string{"from=now-1h&q=a b"}, status: http.StatusOK, expected: url.Values{"from": {"now-1h"}, "q": {"a b"}}},
+		{name: "merged", target: "/?a=1", query: []string{"a=2&b=3"}, status: http.StatusOK, expected: url.Values{"a": {"1", "2"}, "b": {"3"}}},
+		{name: "repeated", target: "/", query: []string{"a=1", "a=2"}, status: http.StatusOK, expected: url.Values{"a": {"1", "2"}}},
+		{name: "none", target: "/?a=1", status: http.StatusOK, expected: url.Values{"a": {"1"}}},
+		{name: "invalid", target: "/", query: []string{"a=%zz"}, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			gotQuery = nil
+			params := url.Values{"target": {server.URL + tt.target}, "query": tt.query}
+			req := httptest.NewRequest("GET", "/probe?"+params.Encode(), nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Got status %d, expected %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.expected != nil && !reflect.DeepEqual(gotQuery, tt.expected) {
+				t.Errorf("Got query %v, expected %v", gotQuery, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerTargetTemplate(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	path := writeTempFile(t, `
+modules:
+  api:
+    target: "`+server.URL+`/{{.id}}/status"
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	testData := []struct {
+		name   string
+		query  string
+		status int
+		path   string
+	}{
+		{name: "expanded", query: "module=api&id=42", status: http.StatusOK, path: "/42/status"},
+		{name: "missing variable", query: "module=api", status: http.StatusBadRequest},
+		{name: "target parameter", query: "module=api&id=42&target=" + url.QueryEscape(server.URL+"/other"), status: http.StatusOK, path: "/other"},
+		{name: "no template", query: "id=42", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPath = ""
+			req := httptest.NewRequest("GET", "/probe?"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("Got status %d, expected %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if gotPath != tt.path {
+				t.Errorf("Got path %q, expected %q", gotPath, tt.path)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerLogin(t *testing.T) {
+	var logins int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			logins++
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != "POST" || string(body) != `{"password": "secret"}` {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	path := writeTempFile(t, `
+modules:
+  session:
+    login:
+      url: `+server.URL+`/login
+      body: '{"password": "secret"}'
+  wrong:
+    login:
+      url: `+server.URL+`/login
+      body: '{"password": "wrong"}'
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	testData := []struct {
+		name     string
+		module   string
+		expected []string
+	}{
+		{name: "logged in", module: "session", expected: []string{"a 1", "up 1"}},
+		{name: "login fails", module: "wrong", expected: []string{"up 0"}},
+		{name: "no login", module: "", expected: []string{"http_status_code 401", "up 0"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?module="+tt.module+"&target="+url.QueryEscape(server.URL+"/data"), nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			out := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+	if logins != 2 {
+		t.Errorf("Got %d logins, expected 2", logins)
+	}
+}
+
+func TestProbeHandlerUnits(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  normalized:
+    normalize_units: true
+    units:
+      - suffix: days
+        unit: seconds
+        scale: 86400
+  custom:
+    units:
+      - suffix: days
+        unit: seconds
+        scale: 86400
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	body := `{"latency_ms": 250, "size_kb": 2, "uptime_days": 1, "count": 3, "ms": 4}`
+	testData := []struct {
+		module   string
+		expected []string
+	}{
+		{module: "normalized", expected: []string{"latency_seconds 0.25", "size_bytes 2048", "uptime_seconds 86400", "count 3", "ms 4"}},
+		{module: "custom", expected: []string{"latency_ms 250", "size_kb 2", "uptime_seconds 86400"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.module, func(t *testing.T) {
+			out := probe(t, body, "&module="+tt.module)
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, "\n"+expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerPagination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		switch r.URL.Path {
+		case "/linked":
+			next := `"/linked?page=` + strconv.Itoa(page+1) + `"`
+			if page == 3 {
+				next = "null"
+			}
+			fmt.Fprintf(w, `{"items": [{"v": %d}], "next": %s}`, page, next)
+		case "/numbered":
+			if page > 2 {
+				w.Write([]byte(`{"items": []}`))
+				return
+			}
+			fmt.Fprintf(w, `{"meta": {"pages": 2}, "items": [{"v": %d}]}`, page)
+		}
+	}))
+	defer server.Close()
+
+	path := writeTempFile(t, `
+modules:
+  linked:
+    pagination:
+      items_path: $.items
+      next_path: $.next
+  numbered:
+    pagination:
+      items_path: $.items
+      page_param: page
+  total:
+    pagination:
+      items_path: $.items
+      page_param: page
+      total_pages_path: $.meta.pages
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	testData := []struct {
+		name     string
+		module   string
+		path     string
+		maxPages int
+		expected []string
+	}{
+		{name: "next link", module: "linked", path: "/linked", maxPages: 10, expected: []string{"items_0_v 1", "items_2_v 3", "pages 3", "up 1"}},
+		{name: "max pages", module: "linked", path: "/linked", maxPages: 2, expected: []string{"items_1_v 2", "pages 2", "up 1"}},
+		{name: "until empty page", module: "numbered", path: "/numbered", maxPages: 10, expected: []string{"items_1_v 2", "meta_pages 2", "pages 3", "up 1"}},
+		{name: "total pages", module: "total", path: "/numbered", maxPages: 10, expected: []string{"items_1_v 2", "pages 2", "up 1"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetMaxPages(tt.maxPages)
+			defer restore()
+
+			req := httptest.NewRequest("GET", "/probe?module="+tt.module+"&target="+url.QueryEscape(server.URL+tt.path), nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			out := rec.Body.String()
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, "\n"+expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			if tt.maxPages == 2 && strings.Contains(out, "items_2_v") {
+				t.Errorf("Expected pages beyond the limit to be skipped, got:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerSigV4(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	path := writeTempFile(t, `
+modules:
+  aws:
+    sigv4:
+      region: eu-west-1
+      service: es
+      access_key: AKID
+      secret_key: secret
+      session_token: token
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/probe?module=aws&target="+url.QueryEscape(server.URL), nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	if out := rec.Body.String(); !strings.Contains(out, "up 1\n") {
+		t.Errorf("Expected up 1, got:\n%s", out)
+	}
+	auth := got.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/es/aws4_request") {
+		t.Errorf("Got Authorization %q, expected a SigV4 signature", auth)
+	}
+	if got.Get("X-Amz-Date") == "" {
+		t.Errorf("Expected an X-Amz-Date header")
+	}
+	if token := got.Get("X-Amz-Security-Token"); token != "token" {
+		t.Errorf("Got X-Amz-Security-Token %q, expected %q", token, "token")
+	}
+}
+
+func TestProbeHandlerMaxMetrics(t *testing.T) {
+	restore := main.SetMaxMetrics(2)
+	defer restore()
+
+	out := probe(t, `[1, 2, 3, 4]`, "&prefix=x_")
+	if n := strings.Count(out, "\nx__"); n != 2 {
+		t.Errorf("Got %d metrics, expected 2:\n%s", n, out)
+	}
+	if !strings.Contains(out, "x_up 1") {
+		t.Errorf("Expected x_up 1, got:\n%s", out)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	testData := []struct {
+		name   string
+		path   string
+		ready  bool
+		status int
+	}{
+		{name: "healthy", path: "/-/healthy", status: http.StatusOK},
+		{name: "not ready", path: "/-/ready", ready: false, status: http.StatusServiceUnavailable},
+		{name: "ready", path: "/-/ready", ready: true, status: http.StatusOK},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetReady(tt.ready)
+			defer restore()
+
+			rec := httptest.NewRecorder()
+			main.NewMux().ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("Got status %d, expected %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	path := writeTempFile(t, "")
+	defer os.Remove(path)
+	defer main.SetConfig(&main.Config{})()
+	defer main.SetConfigFile(path)()
+
+	reload := func(method, content string) int {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		main.ReloadHandler(rec, httptest.NewRequest(method, "/-/reload", nil))
+		return rec.Code
+	}
+	probeModule := func(module string) int {
+		req := httptest.NewRequest("GET", "/probe?module="+module+"&target="+url.QueryEscape(server.URL), nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		return rec.Code
+	}
+
+	if code := reload("POST", "modules:\n  first: {}\n"); code != http.StatusOK {
+		t.Fatalf("Got status %d, expected %d", code, http.StatusOK)
+	}
+	if code := probeModule("first"); code != http.StatusOK {
+		t.Errorf("Got status %d for the reloaded module, expected %d", code, http.StatusOK)
+	}
+
+	if code := reload("POST", "modules:\n  second:\n    timeout: -1s\n"); code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid config, expected %d", code, http.StatusBadRequest)
+	}
+	if code := probeModule("first"); code != http.StatusOK {
+		t.Errorf("Got status %d, expected the old config to be kept", code)
+	}
+	if code := probeModule("second"); code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected the invalid config to be ignored", code)
+	}
+
+	if code := reload("GET", "modules:\n  second: {}\n"); code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status %d for GET, expected %d", code, http.StatusMethodNotAllowed)
+	}
+	if code := probeModule("second"); code != http.StatusBadRequest {
+		t.Errorf("Got status %d, expected GET not to reload", code)
+	}
+}
+
+func TestIndexPage(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  status: {}
+  "<b>x</b>": {}
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	rec := httptest.NewRecorder()
+	main.NewMux().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	out := rec.Body.String()
+	for _, expected := range []string{
+		`<form action="/probe" method="get">`,
+		`<option value="status">status</option>`,
+		`<input type="hidden" name="module" value="status">`,
+		`&lt;b&gt;x&lt;/b&gt;`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "<b>x</b>") {
+		t.Errorf("Module name was not escaped:\n%s", out)
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	rec := httptest.NewRecorder()
+	main.NewMux().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	expected := fmt.Sprintf(`json_exporter_build_info{goversion=%q,revision="unknown",version="dev"} 1`, runtime.Version())
+	if out := rec.Body.String(); !strings.Contains(out, expected) {
+		t.Errorf("Expected %s, got:\n%s", expected, out)
+	}
+}
+
+func TestHeaderNamesSet(t *testing.T) {
+	testData := []struct {
+		value    string
+		expected main.HeaderNames
+		valid    bool
+	}{
+		{value: "x-api-key, X-Tenant", expected: main.HeaderNames{"X-Api-Key", "X-Tenant"}, valid: true},
+		{value: "X-Api-Key,Connection", valid: false},
+		{value: "transfer-encoding", valid: false},
+		{value: "Host", valid: false},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.value, func(t *testing.T) {
+			var names main.HeaderNames
+			err := names.Set(tt.value)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if tt.valid && !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Got: %v, expected: %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestKeyReplacementsSet(t *testing.T) {
+	testData := []struct {
+		value    string
+		key      string
+		expected string
+		valid    bool
+	}{
+		{value: "%=percent,.=_", key: "cpu.used%", expected: "cpu_usedpercent", valid: true},
+		{value: "app_=", key: "app_requests", expected: "requests", valid: true},
+		{value: "", key: "a.b", expected: "a.b", valid: true},
+		{value: "=x", valid: false},
+		{value: "percent", valid: false},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.value, func(t *testing.T) {
+			var r main.KeyReplacements
+			err := r.Set(tt.value)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error: %v, expected valid: %v", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+			got := tt.key
+			if replacer := r.Replacer(); replacer != nil {
+				got = replacer.Replace(got)
+			}
+			if got != tt.expected {
+				t.Errorf("Got: %q, expected: %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerForwardHeaders(t *testing.T) {
+	restore := main.SetForwardHeaders("X-Api-Key", "X-Tenant")
+	defer restore()
+
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("X-Tenant", "billing")
+	req.Header.Set("X-Other", "other")
+	req.Header.Set("Connection", "X-Tenant")
+	main.ProbeHandler(httptest.NewRecorder(), req)
+
+	if v := got.Get("X-Api-Key"); v != "secret" {
+		t.Errorf("Got X-Api-Key %q, expected secret", v)
+	}
+	for _, name := range []string{"X-Tenant", "X-Other"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("Got %s %q, expected it not to be forwarded", name, v)
+		}
+	}
+}
+
+func TestProbeHandlerUserAgent(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  custom:
+    user_agent: custom-agent/1.0
+  header:
+    user_agent: custom-agent/1.0
+    headers:
+      User-Agent: header-agent/1.0
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	testData := []struct {
+		module   string
+		expected string
+	}{
+		{module: "", expected: "prometheus-json-exporter/dev"},
+		{module: "custom", expected: "custom-agent/1.0"},
+		{module: "header", expected: "header-agent/1.0"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.expected, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/probe?module="+tt.module+"&target="+url.QueryEscape(server.URL), nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			if got != tt.expected {
+				t.Errorf("Got User-Agent %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerMetricTypes(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  types:
+    types:
+      - match: "*_total"
+        type: counter
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"requests_total": 42, "in_flight": 3}`, "&module=types")
+	for _, expected := range []string{
+		"# TYPE requests_total counter",
+		"requests_total 42",
+		"# TYPE in_flight gauge",
+		"in_flight 3",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestProbeHandlerExemplars(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  traced:
+    trace_id_path: $.trace.id
+    types:
+      - match: "*_total"
+        type: counter
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+	restoreOpenMetrics := main.SetEnableOpenMetrics(true)
+	defer restoreOpenMetrics()
+
+	// Versions of expfmt print the floats of OpenMetrics output as 42 or
+	// 42.0.
+	testData := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{name: "string", body: `{"trace": {"id": "abc123"}, "requests_total": 42, "in_flight": 3}`, expected: `requests_total 42(\.0)? # \{trace_id="abc123"\} 42(\.0)?\s`},
+		{name: "number", body: `{"trace": {"id": 7}, "requests_total": 42, "in_flight": 3}`, expected: `requests_total 42(\.0)? # \{trace_id="7"\} 42(\.0)?\s`},
+		{name: "missing", body: `{"requests_total": 42, "in_flight": 3}`, expected: `requests_total 42(\.0)?\n`},
+	}
+	gaugeExemplar := regexp.MustCompile(`in_flight 3(\.0)? #`)
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			req := httptest.NewRequest("GET", "/probe?module=traced&target="+url.QueryEscape(server.URL), nil)
+			req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			out := rec.Body.String()
+			if !regexp.MustCompile(tt.expected).MatchString(out) {
+				t.Errorf("Expected %s, got:\n%s", tt.expected, out)
+			}
+			if gaugeExemplar.MatchString(out) {
+				t.Errorf("Expected no exemplar on gauge, got:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestProbeHandlerBase64(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  gateway:
+    base64_paths:
+      - $.reading
+      - $.packet
+      - $.invalid
+      - $.list[0]
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	// "21.5", {"temp": 3}, "7" and "1" encoded.
+	out := probe(t, `{"reading": "MjEuNQ==", "packet": "eyJ0ZW1wIjogM30=", "invalid": "!!", "other": "Nw==", "list": ["MQ=="]}`, "&module=gateway")
+	for _, expected := range []string{"reading 21.5", "packet_temp 3", "list_0 1", "up 1"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{"other", "invalid"} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("Unexpected %s, got:\n%s", unexpected, out)
+		}
+	}
+}
+
+func TestProbeHandlerRewrites(t *testing.T) {
+	body := `{"data": {"result": [{"metric": {"instance": 1}}, {"metric": {"instance": 2}}]}, "debug_level": 3, "size": 4}`
+	testData := []struct {
+		name       string
+		rewrites   string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name: "capture groups",
+			rewrites: `
+      - match: data_result_(\d+)_metric_(.*)
+        replacement: result_${2}_$1`,
+			expected:   []string{"result_instance_0 1", "result_instance_1 2", "size 4"},
+			unexpected: []string{"data_result"},
+		},
+		{
+			name: "named groups",
+			rewrites: `
+      - match: data_result_(?P<n>\d+)_metric_instance
+        replacement: instance_${n}`,
+			expected: []string{"instance_0 1", "instance_1 2"},
+		},
+		{
+			name: "drop",
+			rewrites: `
+      - match: debug_.*
+        replacement: ""`,
+			expected:   []string{"size 4", "data_result_0_metric_instance 1"},
+			unexpected: []string{"debug_level"},
+		},
+		{
+			name: "anchored",
+			rewrites: `
+      - match: ize
+        replacement: dropped`,
+			expected:   []string{"size 4"},
+			unexpected: []string{"dropped"},
+		},
+		{
+			name: "in order",
+			rewrites: `
+      - match: size
+        replacement: total_size
+      - match: total_(.*)
+        replacement: ${1}_total`,
+			expected:   []string{"size_total 4"},
+			unexpected: []string{"total_size"},
+		},
+		{
+			name: "drop stops later rules",
+			rewrites: `
+      - match: size
+        replacement: ""
+      - match: size|debug_level
+        replacement: renamed`,
+			expected:   []string{"renamed 3"},
+			unexpected: []string{"size", "renamed 4"},
+		},
+		{
+			name: "invalid characters are sanitized",
+			rewrites: `
+      - match: size
+        replacement: size.bytes`,
+			expected: []string{"size_bytes 4"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTempFile(t, `
+modules:
+  rewrite:
+    rewrites:`+tt.rewrites+"\n")
+			defer os.Remove(path)
+			config, err := main.LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restore := main.SetConfig(config)
+			defer restore()
+
+			out := probe(t, body, "&module=rewrite")
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Unexpected %s, got:\n%s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerKeyFilters(t *testing.T) {
+	body := `{"cpu_user": 1, "cpu_system": 2, "cpu_debug": 3, "memory": 4}`
+	testData := []struct {
+		name       string
+		include    string
+		exclude    string
+		expected   []string
+		unexpected []string
+	}{
+		{name: "none", expected: []string{"cpu_user 1", "cpu_system 2", "cpu_debug 3", "memory 4"}},
+		{name: "include", include: "cpu_.*", expected: []string{"cpu_user 1", "cpu_system 2", "cpu_debug 3"}, unexpected: []string{"memory"}},
+		{name: "exclude", exclude: "cpu_debug", expected: []string{"cpu_user 1", "cpu_system 2", "memory 4"}, unexpected: []string{"cpu_debug"}},
+		{name: "exclude wins", include: "cpu_.*", exclude: "cpu_(debug|system)", expected: []string{"cpu_user 1"}, unexpected: []string{"cpu_system", "cpu_debug", "memory"}},
+		{name: "anchored", include: "cpu", unexpected: []string{"cpu_user", "memory"}},
+		{name: "exporter metrics", include: "memory", expected: []string{"memory 4", "up 1", "scrape_duration_seconds"}, unexpected: []string{"cpu_"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetKeyFilters(tt.include, tt.exclude)
+			defer restore()
+
+			out := probe(t, body, "")
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Unexpected %s, got:\n%s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerStates(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  log:
+    states:
+      - name: state
+        path: $.status.state
+        values: [running, stopped]
+  add:
+    states:
+      - name: service_state
+        label: state
+        path: $.status.state
+        values: [running, stopped]
+        unknown: add
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	testData := []struct {
+		name       string
+		module     string
+		body       string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name:     "known",
+			module:   "log",
+			body:     `{"status": {"state": "running"}}`,
+			expected: []string{`state{state="running"} 1`, `state{state="stopped"} 0`},
+		},
+		{
+			name:       "unknown logged",
+			module:     "log",
+			body:       `{"status": {"state": "failed"}}`,
+			expected:   []string{`state{state="running"} 0`, `state{state="stopped"} 0`},
+			unexpected: []string{"failed"},
+		},
+		{
+			name:     "unknown added",
+			module:   "add",
+			body:     `{"status": {"state": "failed"}}`,
+			expected: []string{`service_state{state="running"} 0`, `service_state{state="stopped"} 0`, `service_state{state="failed"} 1`},
+		},
+		{
+			name:       "missing",
+			module:     "log",
+			body:       `{"status": {}}`,
+			expected:   []string{"up 1"},
+			unexpected: []string{"state{"},
+		},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, tt.body, "&module="+tt.module)
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Unexpected %s, got:\n%s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerTimestampField(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  timestamped:
+    timestamp_field: collected_at
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	recent := time.Now().Add(-time.Minute).Truncate(time.Second)
+	body := fmt.Sprintf(`{
+		"recent": {"value": 1, "collected_at": %d},
+		"old": {"value": 2, "collected_at": 1000},
+		"future": {"value": 3, "collected_at": %d},
+		"untimed": {"value": 4}
+	}`, recent.Unix(), time.Now().Add(24*time.Hour).Unix())
+	start := time.Now()
+	out := probe(t, body, "&module=timestamped")
+
+	timestamps := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && !strings.HasPrefix(line, "#") {
+			ms, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				t.Fatalf("Invalid timestamp in %q: %v", line, err)
+			}
+			timestamps[fields[0]] = ms
+		}
+	}
+	if got := timestamps["recent_value"]; got != recent.UnixMilli() {
+		t.Errorf("Got recent timestamp %d, expected %d", got, recent.UnixMilli())
+	}
+	if got := timestamps["old_value"]; got < start.Add(-time.Hour).UnixMilli() || got > time.Now().UnixMilli() {
+		t.Errorf("Got old timestamp %d, expected it to be clamped to an hour ago", got)
+	}
+	if got := timestamps["future_value"]; got < start.UnixMilli() || got > time.Now().UnixMilli() {
+		t.Errorf("Got future timestamp %d, expected it to be clamped to now", got)
+	}
+	if _, ok := timestamps["untimed_value"]; ok || !strings.Contains(out, "untimed_value 4") {
+		t.Errorf("Expected untimed_value without timestamp, got:\n%s", out)
+	}
+	if strings.Contains(out, "collected_at") {
+		t.Errorf("Expected the timestamp field not to be exported, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerUpMetric(t *testing.T) {
+	testData := []struct {
+		name       string
+		upName     string
+		disabled   bool
+		expected   []string
+		unexpected []string
+	}{
+		{name: "default", upName: "up", expected: []string{"up 1"}},
+		{name: "renamed", upName: "probe_success", expected: []string{"probe_success 1"}, unexpected: []string{"\nup 1"}},
+		{name: "disabled", upName: "up", disabled: true, unexpected: []string{"up 1", "# HELP up "}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := main.SetUpMetric(tt.upName, tt.disabled)
+			defer restore()
+
+			out := "\n" + probe(t, `{"a": 1}`, "")
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpected {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Unexpected %s, got:\n%s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeHandlerDebug(t *testing.T) {
+	out := probe(t, `{"a": 1, "b": "text", "c": null, "d": "NaN"}`, "&debug=true&prefix=x_")
+
+	var got struct {
+		StatusCode int `json:"status_code"`
+		Values     []struct {
+			Key     string      `json:"key"`
+			Metric  string      `json:"metric"`
+			Value   interface{} `json:"value"`
+			Ignored string      `json:"ignored"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("Error: %v, body:\n%s", err, out)
+	}
+	if got.StatusCode != http.StatusOK {
+		t.Errorf("Got status code %d, expected %d", got.StatusCode, http.StatusOK)
+	}
+	ignored := map[string]string{}
+	for _, v := range got.Values {
+		ignored[v.Key] = v.Ignored
+		if v.Key == "a" && v.Metric != "x_a" {
+			t.Errorf("Got metric %q for a, expected x_a", v.Metric)
+		}
+	}
+	expected := map[string]string{"a": "", "b": "string", "c": "null", "d": "string"}
+	if !reflect.DeepEqual(ignored, expected) {
+		t.Errorf("Got: %v, expected: %v", ignored, expected)
+	}
+}
+
+func TestProbeHandlerDebugMetricNames(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  named:
+    normalize_units: true
+    rewrites:
+      - match: debug_.*
+        replacement: ""
+      - match: size
+        replacement: total_size
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"latency_ms": 250, "size": 4, "debug_level": 3}`, "&module=named&debug=true&prefix=x_")
+	var got struct {
+		Values []struct {
+			Key    string `json:"key"`
+			Metric string `json:"metric"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("Error: %v, body:\n%s", err, out)
+	}
+	metrics := map[string]string{}
+	for _, v := range got.Values {
+		metrics[v.Key] = v.Metric
+	}
+	expected := map[string]string{"latency_ms": "x_latency_seconds", "size": "x_total_size", "debug_level": ""}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Got: %v, expected: %v", metrics, expected)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	restore := main.SetWebAuth("prometheus", "secret")
+	defer restore()
+
+	testData := []struct {
+		name     string
+		path     string
+		username string
+		password string
+		status   int
+	}{
+		{name: "no credentials", path: "/metrics", status: http.StatusUnauthorized},
+		{name: "wrong password", path: "/metrics", username: "prometheus", password: "wrong", status: http.StatusUnauthorized},
+		{name: "wrong username", path: "/probe", username: "other", password: "secret", status: http.StatusUnauthorized},
+		{name: "valid", path: "/metrics", username: "prometheus", password: "secret", status: http.StatusOK},
+		{name: "health", path: "/-/healthy", status: http.StatusOK},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			main.NewMux().ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("Got status %d, expected %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRequireAuthNotForwarded(t *testing.T) {
+	restore := main.SetWebAuth("prometheus", "secret")
+	defer restore()
+	defer main.SetForwardHeaders("Authorization")()
+
+	var gotAuth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Values("Authorization")
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+	req.SetBasicAuth("prometheus", "secret")
+	rec := httptest.NewRecorder()
+	main.NewMux().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(gotAuth) != 0 {
+		t.Errorf("Got Authorization %q at the target, expected none", gotAuth)
+	}
+}
+
+func TestProbeHandlerLabelFields(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  disks:
+    jsonpaths:
+      - name: disk
+        path: $.disks
+        label_fields: [device, mount.path]
+        value_fields: [bytes_used, bytes_free]
+      - name: all
+        path: $.disks
+        label_fields: [device]
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"disks": [
+		{"device": "sda", "mount": {"path": "/"}, "bytes_used": 123, "bytes_free": 7, "errors": 1},
+		{"mount": {"path": "/data"}, "bytes_used": 5}
+	]}`, "&module=disks")
+	for _, expected := range []string{
+		`disk_bytes_used{device="sda",path="/"} 123`,
+		`disk_bytes_free{device="sda",path="/"} 7`,
+		`disk_bytes_used{device="",path="/data"} 5`,
+		`all_errors{device="sda"} 1`,
+		`all_bytes_used{device=""} 5`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "disk_errors") {
+		t.Errorf("Expected only value_fields to be exported, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerLengthMode(t *testing.T) {
+	body := `{"alerts": [{"name": "a"}, {"name": "b"}, {"name": "c"}], "meta": {"x": 1, "y": 2}, "total": 7}`
+	testData := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "document", query: "", expected: []string{"count 3"}},
+		{name: "named array", query: "&jsonpath=" + url.QueryEscape("alerts=$.alerts"), expected: []string{"alerts_count 3"}},
+		{name: "unnamed array", query: "&jsonpath=" + url.QueryEscape("$.alerts"), expected: []string{"count 3"}},
+		{name: "object", query: "&jsonpath=" + url.QueryEscape("meta=$.meta"), expected: []string{"meta_count 2"}},
+		{name: "scalar", query: "&jsonpath=" + url.QueryEscape("total=$.total"), expected: []string{"total 7"}},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, body, "&mode=length"+tt.query)
+			for _, expected := range tt.expected {
+				if !strings.Contains(out, expected+"\n") {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+			if strings.Contains(out, "alerts__0") || strings.Contains(out, "meta_x") {
+				t.Errorf("Expected the values not to be walked, got:\n%s", out)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/probe?target=http://127.0.0.1:0&mode=size", nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an unknown mode, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestProbeHandlerTransform(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  ratios:
+    jsonpaths:
+      - name: percent
+        path: $.ratios
+        transform: ". * 100"
+      - name: per_second
+        path: $.intervals
+        transform: "1 / ."
+      - name: raw
+        path: $.ratios
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+
+	out := probe(t, `{"ratios": {"cpu": 0.25, "disk": 1, "note": "x"}, "intervals": {"a": 0.5, "b": 0}}`, "&module=ratios")
+	for _, expected := range []string{"percent_cpu 25", "percent_disk 100", "per_second_a 2", "raw_cpu 0.25", "json_keys_ignored 3"} {
+		if !strings.Contains(out, expected+"\n") {
+			t.Errorf("Expected %s, got:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "per_second_b") {
+		t.Errorf("Expected the failed transform to be skipped, got:\n%s", out)
+	}
+}
+
+func TestProbeHandlerPrefix(t *testing.T) {
+	path := writeTempFile(t, `
+modules:
+  status:
+    prefix: status_
+  plain: {}
+`)
+	defer os.Remove(path)
+	config, err := main.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := main.SetConfig(config)
+	defer restore()
+	restore = main.SetDefaultPrefix("{{.Module}}_{{.Params.env}}_")
+	defer restore()
+
+	testData := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "query", query: "&module=status&prefix=query_", expected: "query_a 1"},
+		{name: "module", query: "&module=status", expected: "status_a 1"},
+		{name: "default template", query: "&module=plain&env=prod", expected: "plain_prod_a 1"},
+		{name: "query template", query: "&team=billing&prefix=" + url.QueryEscape("{{.Params.team}}_"), expected: "billing_a 1"},
+	}
+
+	for _, tt := range testData {
+		t.Run(tt.name, func(t *testing.T) {
+			out := probe(t, `{"a": 1}`, tt.query)
+			if !strings.Contains(out, tt.expected) {
+				t.Errorf("Expected %s, got:\n%s", tt.expected, out)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/probe?target=http://localhost&prefix="+url.QueryEscape("{{.Host}}."), nil)
+	rec := httptest.NewRecorder()
+	main.ProbeHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an invalid prefix, expected %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestProbeHandlerConditionalRequests(t *testing.T) {
+	restore := main.SetConditionalRequests(10)
+	defer restore()
+
+	var gotIfNoneMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIfNoneMatch = append(gotIfNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	for i, expected := range []string{"response_not_modified 0", "response_not_modified 1"} {
+		req := httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(server.URL), nil)
+		rec := httptest.NewRecorder()
+		main.ProbeHandler(rec, req)
+		out := rec.Body.String()
+		for _, e := range []string{expected, "a 1", "up 1"} {
+			if !strings.Contains(out, e) {
+				t.Errorf("Probe %d: expected %s, got:\n%s", i, e, out)
+			}
+		}
+	}
+	if expected := []string{"", `"v1"`}; !reflect.DeepEqual(gotIfNoneMatch, expected) {
+		t.Errorf("Got If-None-Match: %q, expected: %q", gotIfNoneMatch, expected)
+	}
+}
+
+func TestProbeHandlerMultipleTargets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			restore := main.SetProbeConcurrency(concurrency)
+			defer restore()
+
+			query := "?target=" + url.QueryEscape(server.URL+"/up") + "&target=" + url.QueryEscape(server.URL+"/down")
+			req := httptest.NewRequest("GET", "/probe"+query, nil)
+			rec := httptest.NewRecorder()
+			main.ProbeHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Got status %d: %s", rec.Code, rec.Body.String())
+			}
+			out := rec.Body.String()
+			for _, expected := range []string{
+				fmt.Sprintf(`a{target=%q} 1`, server.URL+"/up"),
+				fmt.Sprintf(`up{target=%q} 1`, server.URL+"/up"),
+				fmt.Sprintf(`up{target=%q} 0`, server.URL+"/down"),
+			} {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected %s, got:\n%s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProbeHandlerTargets(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	params := url.Values{}
+	for i := 0; i < 16; i++ {
+		params.Add("target", server.URL+"/"+strconv.Itoa(i))
+	}
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			restore := main.SetProbeConcurrency(concurrency)
+			defer restore()
+
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				main.ProbeHandler(rec, httptest.NewRequest("GET", "/probe?"+params.Encode(), nil))
 			}
 		})
 	}
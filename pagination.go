@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/yalp/jsonpath"
+)
+
+// maxPages limits the pages fetched by a paginated probe.
+var maxPages = 10
+
+// Pagination describes how to fetch the further pages of a list endpoint.
+// The items of all pages are concatenated into the array at ItemsPath of
+// the first page before it is walked.
+//
+// The next page is either the URL at NextPath of the current page,
+// resolved against it, or, without NextPath, the target with PageParam set
+// to the page number, counting from 1. Paging stops at the last page,
+// which is the page with an empty NextPath, the TotalPagesPath-th page or
+// the first page without items.
+type Pagination struct {
+	ItemsPath      string `yaml:"items_path"`
+	NextPath       string `yaml:"next_path"`
+	PageParam      string `yaml:"page_param"`
+	TotalPagesPath string `yaml:"total_pages_path"`
+}
+
+// fetchPages fetches the pages following first, the document fetched for
+// preq, and returns a copy of first holding the items of all pages and the
+// number of pages fetched. The pages share the deadline of ctx.
+func fetchPages(ctx context.Context, client *http.Client, preq probeRequest, first interface{}, p *Pagination) (interface{}, int, error) {
+	items, err := pageItems(first, p.ItemsPath)
+	if err != nil {
+		return nil, 1, err
+	}
+	pages := 1
+	page, empty := first, len(items) == 0
+	for {
+		next, ok, err := nextPage(preq.Target, page, pages, empty, p)
+		if err != nil {
+			return nil, pages, err
+		}
+		if !ok {
+			break
+		}
+		if pages >= maxPages {
+			slog.Warn("maximum number of pages reached, skipping the rest", "target", redactURL(preq.Target), "max_pages", maxPages)
+			break
+		}
+		preq.Target = next
+		result, err := doProbe(ctx, client, preq)
+		if err != nil {
+			return nil, pages, fmt.Errorf("fetching page %d: %w", pages+1, err)
+		}
+		if !validStatusCodes.contains(result.StatusCode) && !result.NotModified {
+			return nil, pages, fmt.Errorf("fetching page %d: unexpected status %d", pages+1, result.StatusCode)
+		}
+		pages++
+		more, err := pageItems(result.Data, p.ItemsPath)
+		if err != nil {
+			return nil, pages, fmt.Errorf("page %d: %w", pages, err)
+		}
+		items = append(items, more...)
+		page, empty = result.Data, len(more) == 0
+	}
+
+	data := copyJSON(first)
+	m := lastSegmentRE.FindStringSubmatch(p.ItemsPath)
+	parent, err := jsonpath.Read(data, m[1])
+	if err != nil {
+		if len(items) == 0 {
+			return first, pages, nil
+		}
+		return nil, pages, fmt.Errorf("first page has no items at %s", p.ItemsPath)
+	}
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		c[m[2]+m[3]] = items
+	case []interface{}:
+		i, _ := strconv.Atoi(m[4])
+		c[i] = items
+	}
+	return data, pages, nil
+}
+
+// pageItems returns the array of items at path in page. A page without
+// items has an empty array or none at all.
+func pageItems(page interface{}, path string) ([]interface{}, error) {
+	v, err := jsonpath.Read(page, path)
+	if err != nil || v == nil {
+		return nil, nil
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("items at %s are not an array", path)
+	}
+	return items, nil
+}
+
+// nextPage returns the URL of the page following page, the n-th fetched,
+// from target, if there is one to fetch. empty tells whether page had no
+// items.
+func nextPage(target string, page interface{}, n int, empty bool, p *Pagination) (string, bool, error) {
+	if p.NextPath != "" {
+		v, err := jsonpath.Read(page, p.NextPath)
+		if err != nil || v == nil || v == "" {
+			return "", false, nil
+		}
+		link, ok := v.(string)
+		if !ok {
+			return "", false, fmt.Errorf("next page link at %s is not a string", p.NextPath)
+		}
+		base, err := url.Parse(target)
+		if err != nil {
+			return "", false, err
+		}
+		u, err := base.Parse(link)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid next page link: %v", err)
+		}
+		if !targetAllowed(u) {
+			return "", false, fmt.Errorf("next page host %q is not allowed", u.Hostname())
+		}
+		return u.String(), true, nil
+	}
+
+	if p.TotalPagesPath != "" {
+		v, err := jsonpath.Read(page, p.TotalPagesPath)
+		if err != nil {
+			return "", false, nil
+		}
+		total, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		if err != nil {
+			return "", false, fmt.Errorf("total pages at %s is not a number", p.TotalPagesPath)
+		}
+		if float64(n) >= total {
+			return "", false, nil
+		}
+	} else if empty {
+		return "", false, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false, err
+	}
+	q := u.Query()
+	q.Set(p.PageParam, strconv.Itoa(n+1))
+	u.RawQuery = q.Encode()
+	return u.String(), true, nil
+}
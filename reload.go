@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// config holds the probe modules. It is replaced as a whole on reload, so
+// a probe keeps the config it started with.
+var config atomic.Pointer[Config]
+
+// configFile is the path of the config file read by reloadConfig.
+var configFile string
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "json_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload succeeded",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "json_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Unix time of the last successful configuration reload",
+	})
+)
+
+func init() {
+	config.Store(&Config{})
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+}
+
+// reloadConfig loads configFile and replaces the config with it. An
+// invalid file leaves the config in place.
+func reloadConfig() error {
+	if configFile == "" {
+		return errors.New("no config file given with --config.file")
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	c, err := loadConfig(configFile)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		slog.Error("reloading config", "error", err)
+		return err
+	}
+	storeConfig(c)
+	slog.Info("config reloaded", "file", configFile, "modules", len(c.Modules))
+	return nil
+}
+
+// storeConfig replaces the config with c, a successfully loaded one.
+func storeConfig(c *Config) {
+	config.Store(c)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// reloadHandler reloads the config on POST, answering 400 with the error if
+// the config file is invalid.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, "Reloaded")
+}
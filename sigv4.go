@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awscredentials "github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// SigV4 signs probes with AWS Signature Version 4, for targets such as
+// API Gateway or OpenSearch endpoints requiring IAM authentication.
+//
+// Without AccessKey, credentials and, if Region is empty, the region are
+// taken from the default AWS credential chain: the environment, the shared
+// config and credentials files (with Profile if set), and the roles of
+// containers and instances.
+type SigV4 struct {
+	Region       string `yaml:"region"`
+	Service      string `yaml:"service"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    Secret `yaml:"secret_key"`
+	SessionToken Secret `yaml:"session_token"`
+	Profile      string `yaml:"profile"`
+
+	credentials aws.CredentialsProvider
+}
+
+// init resolves the credentials and region of s.
+func (s *SigV4) init(ctx context.Context) error {
+	if s.Service == "" {
+		return errors.New("service is required")
+	}
+	if (s.AccessKey == "") != (s.SecretKey == "") {
+		return errors.New("both access_key and secret_key must be given")
+	}
+	if s.AccessKey != "" {
+		if s.Region == "" {
+			return errors.New("region is required with access_key")
+		}
+		s.credentials = awscredentials.NewStaticCredentialsProvider(s.AccessKey, string(s.SecretKey), string(s.SessionToken))
+		return nil
+	}
+	var opts []func(*awsconfig.LoadOptions) error
+	if s.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(s.Region))
+	}
+	if s.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(s.Profile))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	if cfg.Region == "" {
+		return errors.New("region is required, none is configured for the default credential chain")
+	}
+	s.Region = cfg.Region
+	s.credentials = cfg.Credentials
+	return nil
+}
+
+// sign signs req, whose body is body, replacing any Authorization header.
+func (s *SigV4) sign(ctx context.Context, req *http.Request, body string) error {
+	creds, err := s.credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(body))
+	return v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), s.Service, s.Region, time.Now())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxSuccessTargets bounds the targets whose last success is remembered;
+// the one that succeeded longest ago is forgotten first.
+const maxSuccessTargets = 10000
+
+// lastSuccess remembers when each target last succeeded, for
+// last_success_timestamp_seconds.
+var lastSuccess = &successStore{times: map[string]time.Time{}}
+
+// successStore holds the time of the last successful probe by module and
+// target.
+type successStore struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func successKey(module, target string) string {
+	return module + "\n" + target
+}
+
+// record notes that the probe of target with module succeeded at t.
+func (s *successStore) record(module, target string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := successKey(module, target)
+	if _, ok := s.times[key]; !ok && len(s.times) >= maxSuccessTargets {
+		var oldest string
+		for k, v := range s.times {
+			if oldest == "" || v.Before(s.times[oldest]) {
+				oldest = k
+			}
+		}
+		delete(s.times, oldest)
+	}
+	s.times[key] = t
+}
+
+// get returns when the probe of target with module last succeeded.
+func (s *successStore) get(module, target string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.times[successKey(module, target)]
+	return t, ok
+}
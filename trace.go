@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// httpTrace enables measuring the connect, TLS handshake and first byte
+// phases of probes.
+var httpTrace bool
+
+// probeTracer measures the phases of the requests sent by a probe. Its
+// hooks may be called from the transport's dialing goroutines, even after
+// the request is done, so access is locked.
+type probeTracer struct {
+	mu sync.Mutex
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	getConn      time.Time
+
+	dnsLookup    time.Duration
+	connect      time.Duration
+	tlsHandshake time.Duration
+	firstByte    time.Duration
+}
+
+// clientTrace returns the hooks recording the phases into t. Only the DNS
+// lookup is measured unless phases is set.
+func (t *probeTracer) clientTrace(phases bool) *httptrace.ClientTrace {
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsLookup += time.Since(t.dnsStart)
+		},
+	}
+	if !phases {
+		return trace
+	}
+	trace.GetConn = func(string) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.getConn = time.Now()
+	}
+	trace.ConnectStart = func(string, string) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.connectStart = time.Now()
+	}
+	trace.ConnectDone = func(string, string, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.connect += time.Since(t.connectStart)
+	}
+	trace.TLSHandshakeStart = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.tlsStart = time.Now()
+	}
+	trace.TLSHandshakeDone = func(tls.ConnectionState, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.tlsHandshake += time.Since(t.tlsStart)
+	}
+	trace.GotFirstResponseByte = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.firstByte = time.Since(t.getConn)
+	}
+	return trace
+}
+
+// record stores the measured phases in result. The times of retries and
+// redirects are summed, except for the first byte which is that of the
+// last request.
+func (t *probeTracer) record(result *probeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result.DNSLookup = t.dnsLookup
+	result.Connect = t.connect
+	result.TLSHandshake = t.tlsHandshake
+	result.FirstByte = t.firstByte
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errInvalidXML = errors.New("invalid XML")
+
+// maxXMLDepth is the deepest element nesting decodeXML accepts.
+const maxXMLDepth = 1000
+
+// decodeXML parses an XML document into the nested maps WalkJSON walks.
+// The root element becomes the only key of the top-level map. An element
+// becomes a map of its attributes and child elements, with the children
+// sharing a name collected in an array, and any text under "text"; an
+// element with only text is replaced by it. Text that is a JSON number
+// becomes a json.Number. Namespaces are dropped from names.
+func decodeXML(data []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no root element", errInvalidXML)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidXML, err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			v, err := xmlElement(decoder, start, 1)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidXML, err)
+			}
+			return map[string]interface{}{start.Name.Local: v}, nil
+		}
+	}
+}
+
+// xmlElement decodes the element opened by start, up to its end. depth
+// is the nesting of start, 1 for the root element.
+func xmlElement(decoder *xml.Decoder, start xml.StartElement, depth int) (interface{}, error) {
+	if depth > maxXMLDepth {
+		return nil, fmt.Errorf("elements nested deeper than %d", maxXMLDepth)
+	}
+	m := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		m[attr.Name.Local] = xmlText(attr.Value)
+	}
+	var text strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			v, err := xmlElement(decoder, t, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			name := t.Name.Local
+			switch prev := m[name].(type) {
+			case nil:
+				m[name] = v
+			case []interface{}:
+				m[name] = append(prev, v)
+			default:
+				m[name] = []interface{}{prev, v}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(m) == 0 {
+				return xmlText(s), nil
+			}
+			if s != "" {
+				m["text"] = xmlText(s)
+			}
+			return m, nil
+		}
+	}
+}
+
+// xmlText returns s as a json.Number if it is a JSON number, otherwise as
+// a string.
+func xmlText(s string) interface{} {
+	if s != "" && (s[0] == '-' || s[0] >= '0' && s[0] <= '9') && json.Valid([]byte(s)) {
+		return json.Number(s)
+	}
+	return s
+}